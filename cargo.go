@@ -1,28 +1,46 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/easeway/cargo/libcargo"
 	"github.com/op/go-logging"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 var (
-	optFile     = "cargo.yml"
-	optDataDir  = "."
-	optRegistry = ""
-	optDetach   = false
-	optHold     = false
-	optPrepare  = true
-	optCreate   = true
-	optRemove   = true
-	optForce    = false
-	optLogVV    = false
-	optLogV     = false
-	optLogQ     = false
-	optLogQQ    = false
+	optFile      = "cargo.yml"
+	optDataDir   = "."
+	optRegistry  = ""
+	optDetach    = false
+	optHold      = false
+	optPrepare   = true
+	optCreate    = true
+	optRemove    = true
+	optForce     = false
+	optLogVV     = false
+	optLogV      = false
+	optLogQ      = false
+	optLogQQ     = false
+	optJson      = false
+	optFollow    = false
+	optSince     = ""
+	optTail      = "all"
+	optAll       = false
+	optStrict    = false
+	optDryRun    = false
+	optRun       = false
+	optNoCache   = false
+	optKeepGoing = false
 
 	env      *cargo.CloudEnv
 	clusters *cargo.Clusters
@@ -57,6 +75,9 @@ func main() {
 	runCmd.Flags().BoolVar(&optDetach, "detach", optDetach, "Detach containers instead of stop after run commands")
 	runCmd.Flags().BoolVar(&optHold, "hold", optHold, "Wait Ctrl-C before stopping the containers")
 	runCmd.Flags().BoolVarP(&optRemove, "remove", "r", optRemove, "Remove all containers after stop")
+	runCmd.Flags().BoolVar(&optDryRun, "dry-run", optDryRun, "Print the plan without running")
+	runCmd.Flags().BoolVar(&optNoCache, "no-cache", optNoCache, "Rebuild prepared images")
+	runCmd.Flags().BoolVar(&optKeepGoing, "keep-going", optKeepGoing, "Keep going instead of aborting the cluster on the first failure")
 
 	rootCmd.AddCommand(runCmd)
 
@@ -69,6 +90,10 @@ func main() {
 	upCmd.Flags().BoolVar(&optCreate, "create", optCreate, "Re-create containers")
 	upCmd.Flags().BoolVar(&optPrepare, "prepare", optPrepare, "Run prepare commands")
 	upCmd.Flags().BoolVar(&optDetach, "detach", optDetach, "Detach containers instead of wait")
+	upCmd.Flags().BoolVarP(&optRemove, "remove", "r", optRemove, "Remove all containers after stop")
+	upCmd.Flags().BoolVar(&optDryRun, "dry-run", optDryRun, "Print the plan without starting")
+	upCmd.Flags().BoolVar(&optNoCache, "no-cache", optNoCache, "Rebuild prepared images")
+	upCmd.Flags().BoolVar(&optKeepGoing, "keep-going", optKeepGoing, "Keep going instead of aborting the cluster on the first failure")
 	rootCmd.AddCommand(upCmd)
 
 	stopCmd := &cobra.Command{
@@ -81,6 +106,88 @@ func main() {
 	stopCmd.Flags().BoolVar(&optForce, "force", optForce, "Force stop/remove containers")
 	rootCmd.AddCommand(stopCmd)
 
+	statusCmd := &cobra.Command{
+		Use:     "status [CLUSTER]",
+		Aliases: []string{"ps"},
+		Short:   "Show the cluster",
+		Long:    "Show the state of all the containers",
+		Run:     showStatus,
+	}
+	statusCmd.Flags().BoolVar(&optJson, "json", optJson, "Output in JSON format")
+	rootCmd.AddCommand(statusCmd)
+
+	logsCmd := &cobra.Command{
+		Use:   "logs [CLUSTER] [NODE[-INDEX]...]",
+		Short: "Show logs",
+		Long:  "Show logs of all or selected containers in the cluster",
+		Run:   showLogs,
+	}
+	logsCmd.Flags().BoolVar(&optFollow, "follow", optFollow, "Follow log output")
+	logsCmd.Flags().StringVar(&optSince, "since", optSince, "Show logs since timestamp or relative time (e.g. 10m)")
+	logsCmd.Flags().StringVar(&optTail, "tail", optTail, "Number of lines to show from the end of the logs")
+	rootCmd.AddCommand(logsCmd)
+
+	execCmd := &cobra.Command{
+		Use:   "exec [CLUSTER] NODE-INDEX -- COMMAND",
+		Short: "Run a command",
+		Long:  "Run a command in a running instance of the cluster using the shell of the run section",
+		Run:   execCommand,
+	}
+	execCmd.Flags().BoolVar(&optAll, "all", optAll, "Run in all instances of the node, specified as NODE")
+	rootCmd.AddCommand(execCmd)
+
+	shellCmd := &cobra.Command{
+		Use:   "shell [CLUSTER] NODE-INDEX",
+		Short: "Open a shell",
+		Long:  "Open an interactive shell in a running instance of the cluster",
+		Run:   openShell,
+	}
+	rootCmd.AddCommand(shellCmd)
+
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the definition file",
+		Long:  "Validate the cloud definition file and report all the problems",
+		Run:   validateFile,
+	}
+	validateCmd.Flags().BoolVar(&optStrict, "strict", optStrict, "Treat warnings (e.g. unknown keys) as errors")
+	rootCmd.AddCommand(validateCmd)
+
+	renderCmd := &cobra.Command{
+		Use:   "render [CLUSTER]",
+		Short: "Show the plan",
+		Long:  "Show the fully resolved plan without touching docker",
+		Run:   renderPlan,
+	}
+	renderCmd.Flags().BoolVar(&optJson, "json", optJson, "Output in JSON format")
+	rootCmd.AddCommand(renderCmd)
+
+	restartCmd := &cobra.Command{
+		Use:   "restart [CLUSTER] NODE[-INDEX]...",
+		Short: "Restart nodes or instances",
+		Long:  "Re-create and start the containers of nodes or instances in a running cluster",
+		Run:   restartInstances,
+	}
+	restartCmd.Flags().BoolVar(&optRun, "run", optRun, "Run the run commands again")
+	rootCmd.AddCommand(restartCmd)
+
+	scaleCmd := &cobra.Command{
+		Use:   "scale [CLUSTER] NODE=N...",
+		Short: "Scale nodes",
+		Long:  "Change the number of instances of nodes in a running cluster",
+		Run:   scaleNodes,
+	}
+	scaleCmd.Flags().BoolVar(&optRun, "run", optRun, "Run the run commands in new instances")
+	rootCmd.AddCommand(scaleCmd)
+
+	hookCmd := &cobra.Command{
+		Use:   "hook NAME [CLUSTER]",
+		Short: "Run a hook",
+		Long:  "Run a named set of commands in all running instances defining it",
+		Run:   runHook,
+	}
+	rootCmd.AddCommand(hookCmd)
+
 	rootCmd.Execute()
 }
 
@@ -100,6 +207,28 @@ func ensure(err error) {
 }
 
 func initEnv(args []string) {
+	loadEnv()
+	if len(args) > 0 {
+		selectCluster(args[0])
+	} else {
+		selectCluster("")
+	}
+}
+
+// initEnvWithRefs initializes the environment for commands accepting an
+// optional cluster name followed by instance references, and returns the
+// references.
+func initEnvWithRefs(args []string) []string {
+	loadEnv()
+	if len(args) > 0 && clusters.ClusterByName(args[0]) != nil {
+		selectCluster(args[0])
+		return args[1:]
+	}
+	selectCluster("")
+	return args
+}
+
+func loadEnv() {
 	backend := logging.AddModuleLevel(
 		logging.NewBackendFormatter(
 			logging.NewLogBackend(os.Stdout, "\x1b[32mCARGO \u27a4\x1b[0m ", 0),
@@ -122,20 +251,22 @@ func initEnv(args []string) {
 	if clusters, err = cargo.LoadYaml(optFile); err != nil {
 		fatal(err)
 	}
-	if len(args) > 0 {
-		if env.Cluster = clusters.ClusterByName(args[0]); env.Cluster == nil {
-			fatal(errors.New("Cluster not found: " + args[0]))
-		}
-	} else if env.Cluster = clusters.DefaultCluster(); env.Cluster == nil {
-		fatal(errorNoDefaultCluster)
-	}
-
 	if env.DataDir, err = filepath.Abs(optDataDir); err != nil {
 		fatal(err)
 	}
 	env.Registry = optRegistry
 }
 
+func selectCluster(name string) {
+	if name != "" {
+		if env.Cluster = clusters.ClusterByName(name); env.Cluster == nil {
+			fatal(errors.New("Cluster not found: " + name))
+		}
+	} else if env.Cluster = clusters.DefaultCluster(); env.Cluster == nil {
+		fatal(errorNoDefaultCluster)
+	}
+}
+
 func startCloud(cmd *cobra.Command, args []string) {
 	initEnv(args)
 	if optCreate {
@@ -150,10 +281,34 @@ func startCloud(cmd *cobra.Command, args []string) {
 	if optRemove {
 		env.RunFlags |= cargo.Remove
 	}
+	if optNoCache {
+		env.RunFlags |= cargo.NoCache
+	}
+	if optKeepGoing {
+		env.RunFlags |= cargo.KeepGoing
+	}
+	if optDryRun {
+		printPlan()
+		return
+	}
 
-	if state := env.Run(); state.AnyError() {
+	state := env.NewState()
+	interrupted := trapSignals(state)
+	state.Run()
+	if state.AnyError() || state.Aborted() {
+		state.StopAndWait()
 		os.Exit(1)
 	}
+
+	if !optDetach {
+		supervisor := state.Supervise()
+		select {
+		case <-interrupted:
+		case <-supervisor.Done():
+		}
+		supervisor.Stop()
+		state.StopAndWait()
+	}
 }
 
 func runCloud(cmd *cobra.Command, args []string) {
@@ -173,22 +328,296 @@ func runCloud(cmd *cobra.Command, args []string) {
 	if optRemove {
 		env.RunFlags |= cargo.Remove
 	}
+	if optNoCache {
+		env.RunFlags |= cargo.NoCache
+	}
+	if optKeepGoing {
+		env.RunFlags |= cargo.KeepGoing
+	}
+	if optDryRun {
+		printPlan()
+		return
+	}
 
-	state := env.Run()
-	if state.AnyError() {
+	state := env.NewState()
+	interrupted := trapSignals(state)
+	state.Run()
+	if state.AnyError() || state.Aborted() {
 		state.StopAndWait()
 		os.Exit(1)
 	}
 
 	if !optDetach {
 		if optHold {
-			// TODO wait for stop
+			env.Logger.Info("Holding cluster %s, press Ctrl-C to stop", env.Cluster.Name)
+			supervisor := state.Supervise()
+			<-interrupted
+			supervisor.Stop()
 		}
 		state.StopAndWait()
 	}
 }
 
+// trapSignals aborts the cluster on SIGINT or SIGTERM, and the returned
+// channel is closed. A second signal exits immediately without cleanup.
+func trapSignals(state *cargo.CloudState) <-chan struct{} {
+	interrupted := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		env.Logger.Warning("Received %v, aborting cluster %s", sig, env.Cluster.Name)
+		state.Abort()
+		close(interrupted)
+		sig = <-signals
+		env.Logger.Critical("Received %v again, exit without cleanup", sig)
+		os.Exit(1)
+	}()
+	return interrupted
+}
+
 func stopCloud(cmd *cobra.Command, args []string) {
 	initEnv(args)
-	// TODO
+	if optRemove {
+		env.RunFlags |= cargo.Remove
+	}
+	if optForce {
+		env.RunFlags |= cargo.Force
+	}
+
+	state, err := env.Attach()
+	ensure(err)
+	if state.Instances() == 0 {
+		env.Logger.Warning("No instances found for cluster %s", env.Cluster.Name)
+		return
+	}
+	state.Shutdown()
+	if state.AnyError() {
+		os.Exit(1)
+	}
+}
+
+func showStatus(cmd *cobra.Command, args []string) {
+	initEnv(args)
+	state, err := env.Attach()
+	ensure(err)
+	status := state.Status()
+	if optJson {
+		encoded, err := json.MarshalIndent(status, "", "  ")
+		ensure(err)
+		fmt.Println(string(encoded))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tINSTANCE\tCONTAINER\tSTATE\tEXIT\tIP\tMAC\tUPTIME")
+	for _, s := range status {
+		if s.Instance == "" {
+			fmt.Fprintf(w, "%s\t-\t-\t%s\t-\t-\t-\t-\n", s.Node, s.State)
+			continue
+		}
+		cid := s.ContainerId
+		if len(cid) > 12 {
+			cid = cid[0:12]
+		}
+		uptime := "-"
+		if s.Uptime > 0 {
+			uptime = (time.Duration(s.Uptime) * time.Second).String()
+		}
+		state := s.State
+		if s.Error != "" {
+			state += ": " + s.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\n",
+			s.Node, s.Instance, cid, state, s.ExitCode, s.IP, s.MAC, uptime)
+	}
+	w.Flush()
+}
+
+func showLogs(cmd *cobra.Command, args []string) {
+	refs := initEnvWithRefs(args)
+	state, err := env.Attach()
+	ensure(err)
+	instances, err := state.SelectInstances(refs)
+	ensure(err)
+	opts := &cargo.LogsOptions{Follow: optFollow, Since: optSince, Tail: optTail}
+	ensure(state.Logs(instances, opts, os.Stdout, os.Stderr))
+}
+
+func execCommand(cmd *cobra.Command, args []string) {
+	targets, command := args, []string{}
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		targets, command = args[0:dash], args[dash:]
+	} else if len(args) > 0 {
+		targets, command = args[0:1], args[1:]
+	}
+	if len(targets) == 0 || len(targets) > 2 || len(command) == 0 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	initEnv(targets[0 : len(targets)-1])
+	target := targets[len(targets)-1]
+
+	state, err := env.Attach()
+	ensure(err)
+	var instances []*cargo.InstanceState
+	if optAll {
+		if state.NodeByName(target) == nil {
+			fatal(errors.New("Node not found: " + target))
+		}
+		instances, err = state.SelectInstances([]string{target})
+	} else if is := state.InstanceByRef(target); is == nil || is.ContainerId == "" {
+		err = errors.New("Instance not found: " + target)
+	} else {
+		instances = []*cargo.InstanceState{is}
+	}
+	ensure(err)
+
+	// the same as the commands in run, the shell interprets the command line
+	// so a single argument is passed verbatim
+	exitCode := 0
+	for _, result := range state.Exec(instances, strings.Join(command, " "), os.Stdout, os.Stderr) {
+		if result.Error != nil {
+			env.Logger.Error("%s: %v", result.Instance.Ref(), result.Error)
+			result.ExitCode = 1
+		} else if len(instances) > 1 {
+			env.Logger.Debug("%s: exit %v", result.Instance.Ref(), result.ExitCode)
+		}
+		if exitCode == 0 {
+			exitCode = result.ExitCode
+		}
+	}
+	os.Exit(exitCode)
+}
+
+func openShell(cmd *cobra.Command, args []string) {
+	refs := initEnvWithRefs(args)
+	if len(refs) != 1 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	state, err := env.Attach()
+	ensure(err)
+	is := state.InstanceByRef(refs[0])
+	if is == nil || is.ContainerId == "" {
+		fatal(errors.New("Instance not found: " + refs[0]))
+	}
+
+	tty := false
+	if info, err := os.Stdin.Stat(); err == nil {
+		tty = (info.Mode() & os.ModeCharDevice) != 0
+	}
+	exitCode, err := is.Shell(tty)
+	ensure(err)
+	os.Exit(exitCode)
+}
+
+func validateFile(cmd *cobra.Command, args []string) {
+	errs, err := cargo.ValidateYaml(optFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", optFile, err)
+		os.Exit(1)
+	}
+	failed := false
+	for _, e := range errs {
+		severity := "error"
+		if e.Warning {
+			severity = "warning"
+		}
+		failed = failed || !e.Warning || optStrict
+		fmt.Fprintf(os.Stderr, "%s:%v:%v: %s: %s: %s\n", optFile, e.Line, e.Column, severity, e.Path, e.Message)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func renderPlan(cmd *cobra.Command, args []string) {
+	initEnv(args)
+	printPlan()
+}
+
+func printPlan() {
+	plan := env.Plan()
+	if optJson {
+		encoded, err := json.MarshalIndent(plan, "", "  ")
+		ensure(err)
+		fmt.Println(string(encoded))
+	} else {
+		plan.Write(os.Stdout)
+	}
+}
+
+func restartInstances(cmd *cobra.Command, args []string) {
+	refs := initEnvWithRefs(args)
+	if len(refs) == 0 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	if optRun {
+		env.RunFlags |= cargo.Run
+	}
+	state, err := env.Attach()
+	ensure(err)
+	instances, err := state.SelectInstances(refs)
+	ensure(err)
+	trapSignals(state)
+	state.Restart(instances)
+	if state.AnyError() {
+		os.Exit(1)
+	}
+}
+
+func runHook(cmd *cobra.Command, args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	initEnv(args[1:])
+	state, err := env.Attach()
+	ensure(err)
+	instances, err := state.SelectInstances(nil)
+	ensure(err)
+	trapSignals(state)
+	ensure(state.RunHook(args[0], instances, os.Stdout, os.Stderr))
+	if state.AnyError() {
+		os.Exit(1)
+	}
+}
+
+func scaleNodes(cmd *cobra.Command, args []string) {
+	refs := initEnvWithRefs(args)
+	if len(refs) == 0 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	if optRun {
+		env.RunFlags |= cargo.Run
+	}
+	state, err := env.Attach()
+	ensure(err)
+
+	nodes := make([]*cargo.NodeState, len(refs))
+	counts := make([]uint, len(refs))
+	for n, ref := range refs {
+		pos := strings.Index(ref, "=")
+		if pos <= 0 {
+			fatal(errors.New("Expect NODE=N: " + ref))
+		}
+		if nodes[n] = state.NodeByName(ref[0:pos]); nodes[n] == nil {
+			fatal(errors.New("Node not found: " + ref[0:pos]))
+		}
+		count, err := strconv.ParseUint(ref[pos+1:], 10, 32)
+		if err != nil {
+			fatal(errors.New("Bad instance count: " + ref))
+		}
+		counts[n] = uint(count)
+	}
+	trapSignals(state)
+	for n, ns := range nodes {
+		state.Scale(ns, counts[n])
+	}
+	if state.AnyError() {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,191 @@
+package cargo
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// capture copies the files listed in the capture section out of the
+// container according to their when settings and whether the commands
+// succeeded. The local paths are substituted per instance, and relative ones
+// are placed in the data directory, or in the archive if specified. The
+// archive is per instance, so the instance reference is inserted before the
+// extension unless the substituted path already contains it. Remote globs
+// are expanded in the container and the matches are copied into the local
+// directory keeping their paths relative to the directory of the glob.
+func (is *InstanceState) capture(succeeded bool) error {
+	cs := is.NodeState.State
+	capture := &is.NodeState.Node.Capture
+	files := make([]CaptureFile, 0, len(capture.Files))
+	for _, file := range capture.Files {
+		if file.When == CaptureAlways ||
+			(file.When == CaptureSuccess && succeeded) ||
+			(file.When == CaptureFailure && !succeeded) {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	varCtx := &VarContext{Cloud: cs, Node: is.NodeState, Instance: is}
+	baseDir := cs.Env.DataDir
+	archive := ""
+	if capture.Archive != "" {
+		if archive = cs.Substitute(capture.Archive, varCtx); !path.IsAbs(archive) {
+			archive = path.Join(cs.Env.DataDir, archive)
+		}
+		if !strings.Contains(path.Base(archive), is.Ref()) {
+			archive = instanceArchive(archive, is.Ref())
+		}
+		baseDir = path.Join(cs.stateDir, is.name()+".capture")
+		if err := os.RemoveAll(baseDir); err != nil {
+			return err
+		}
+		defer os.RemoveAll(baseDir)
+	}
+
+	var firstErr error
+	for _, file := range files {
+		remote := cs.Substitute(file.Remote, varCtx)
+		local := cs.Substitute(file.Local, varCtx)
+		if archive != "" || !path.IsAbs(local) {
+			local = path.Join(baseDir, local)
+		}
+		if err := is.captureFile(remote, local); err != nil {
+			is.Logger.Error("CAPTURE %s: %v", remote, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if archive != "" {
+		is.Logger.Info("ARCHIVE %s", archive)
+		if err := writeArchive(archive, baseDir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (is *InstanceState) captureFile(remote, local string) error {
+	if !isGlob(remote) {
+		is.Logger.Info("CAPTURE %s -> %s", remote, local)
+		if err := os.MkdirAll(path.Dir(local), 0777); err != nil {
+			return err
+		}
+		return is.cleanupDocker().CopyFrom(is.ContainerId, remote, local)
+	}
+
+	// the glob is passed as an argument and only expanded as a pattern
+	shell := is.NodeState.Node.Shell("run")
+	script := "IFS=; for f in $1; do [ -e \"$f\" ] && echo \"$f\"; done; true"
+	out, err := is.cleanupDocker().ExecOutput(is.ContainerId, shell, "-c", script, shell, remote)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(local, 0777); err != nil {
+		return err
+	}
+	base := globBase(remote)
+	for _, match := range strings.Split(out, "\n") {
+		if match = strings.TrimSpace(match); match == "" {
+			continue
+		}
+		dest := path.Join(local, strings.TrimPrefix(match, base))
+		is.Logger.Info("CAPTURE %s -> %s", match, dest)
+		if err = os.MkdirAll(path.Dir(dest), 0777); err != nil {
+			return err
+		}
+		if err = is.cleanupDocker().CopyFrom(is.ContainerId, match, dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globBase returns the leading directories of pattern without any glob
+// characters, including the trailing slash.
+func globBase(pattern string) string {
+	base := ""
+	for {
+		n := strings.Index(pattern, "/")
+		if n < 0 || isGlob(pattern[:n]) {
+			return base
+		}
+		base, pattern = base+pattern[:n+1], pattern[n+1:]
+	}
+}
+
+// instanceArchive inserts the instance reference before the extension of
+// the archive file name, e.g. logs.tar.gz becomes logs-web-0.tar.gz.
+func instanceArchive(archive, ref string) string {
+	dir, name := path.Split(archive)
+	ext := path.Ext(name)
+	if strings.HasSuffix(name, ".tar"+ext) {
+		ext = ".tar" + ext
+	}
+	return dir + strings.TrimSuffix(name, ext) + "-" + ref + ext
+}
+
+// writeArchive bundles everything in dir into a .tar.gz file.
+func writeArchive(fn, dir string) error {
+	if err := os.MkdirAll(path.Dir(fn), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(dir, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, fn)
+		if err != nil || name == "." {
+			return err
+		}
+		link := ""
+		if (info.Mode() & os.ModeSymlink) != 0 {
+			if link, err = os.Readlink(fn); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err = tw.WriteHeader(header); err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		src, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -1,9 +1,10 @@
 package cargo
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path"
 	"regexp"
@@ -11,20 +12,29 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
-	Create  = 0x0001
-	Prepare = 0x0002
-	Run     = 0x0004
-	Detach  = 0x0008
-	Stop    = 0x0010
-	Remove  = 0x0020
+	Create    = 0x0001
+	Prepare   = 0x0002
+	Run       = 0x0004
+	Detach    = 0x0008
+	Stop      = 0x0010
+	Remove    = 0x0020
+	Force     = 0x0040
+	DryRun    = 0x0080
+	NoCache   = 0x0100
+	KeepGoing = 0x0200
 
 	workspace = "/.cargo.workspace"
 	states    = ".cargo"
 )
 
+var (
+	errorAborted = errors.New("Aborted")
+)
+
 type Logger interface {
 	NewLogger(name string) Logger
 	Critical(fmt string, args ...interface{})
@@ -58,12 +68,14 @@ type CloudState struct {
 	Nodes     []NodeState
 	WaitGroup sync.WaitGroup
 
-	stateDir  string
-	workspace string
-	vars      VarRepository
+	stateDir string
+	vars     VarRepository
 
-	lock sync.Mutex
-	cond *sync.Cond
+	lock   sync.Mutex
+	cond   *sync.Cond
+	ctx    context.Context
+	cancel context.CancelFunc
+	failed int32
 }
 
 type NodeState struct {
@@ -83,11 +95,27 @@ type InstanceState struct {
 	Index       uint
 	ContainerId string
 	LocalVars   VarRepository
+	Results     []CommandResult
 	Logger      Logger
 	Error       error
+	Ready       bool
 	Stopped     bool
 
-	cidfile string
+	cidfile  string
+	stopping bool
+}
+
+// CommandResult is the outcome of running a command in an instance. Error
+// is set if the command failed, including when ExitCode is non-zero.
+type CommandResult struct {
+	Section  string
+	Command  string
+	ExitCode int
+	Duration time.Duration
+	Attempts uint
+	Stdout   string
+	Stderr   string
+	Error    error
 }
 
 func (cs *CloudState) Lock() {
@@ -106,6 +134,55 @@ func (cs *CloudState) Notify() {
 	cs.cond.Broadcast()
 }
 
+// Abort cancels the cluster: no more containers are created, the running
+// docker commands are killed, and the pending variable lookups return. It
+// is safe to be called from another goroutine, e.g. a signal handler.
+func (cs *CloudState) Abort() {
+	cs.cancel()
+	cs.Lock()
+	cs.Notify()
+	cs.Unlock()
+}
+
+func (cs *CloudState) Aborted() bool {
+	return cs.ctx.Err() != nil
+}
+
+// fail aborts the cluster on the first failure unless KeepGoing is set.
+func (cs *CloudState) fail(err error) {
+	if err == nil || err == errorAborted || (cs.Env.RunFlags&KeepGoing) != 0 || cs.Aborted() {
+		return
+	}
+	cs.Env.Logger.Error("Aborting cluster %s: %v", cs.Env.Cluster.Name, err)
+	atomic.StoreInt32(&cs.failed, 1)
+	cs.Abort()
+}
+
+// failedFast tells whether the cluster is aborted by a failure rather than
+// interrupted by the user.
+func (cs *CloudState) failedFast() bool {
+	return atomic.LoadInt32(&cs.failed) != 0
+}
+
+// sleep waits for the duration, and returns errorAborted if the cluster is
+// aborted in the meantime.
+func (cs *CloudState) sleep(d time.Duration) error {
+	return sleepContext(cs.ctx, d)
+}
+
+// sleepContext waits for the duration, and returns errorAborted if ctx is
+// done in the meantime.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errorAborted
+	}
+}
+
 func (cs *CloudState) LoadImage(name string) error {
 	cs.Lock()
 	loader, exists := cs.Images[name]
@@ -137,9 +214,9 @@ func (cs *CloudState) Substitute(text string, context *VarContext) string {
 		if start > curpos {
 			result += text[curpos:start]
 		}
-		curpos = end + 1
+		curpos = end
 		name := text[start+2 : end-1]
-		if val, exists := cs.vars.QueryVar(name, context); exists {
+		if val, exists := cs.queryVar(name, context); exists {
 			result += val
 		}
 	}
@@ -149,6 +226,22 @@ func (cs *CloudState) Substitute(text string, context *VarContext) string {
 	return result
 }
 
+// queryVar looks up the variable in the local variables of the instance and
+// the node in the context before the global ones.
+func (cs *CloudState) queryVar(name string, context *VarContext) (string, bool) {
+	if context != nil && context.Instance != nil {
+		if val, exists := context.Instance.LocalVars.QueryVar(name, context); exists {
+			return val, exists
+		}
+	}
+	if context != nil && context.Node != nil {
+		if val, exists := context.Node.LocalVars.QueryVar(name, context); exists {
+			return val, exists
+		}
+	}
+	return cs.vars.QueryVar(name, context)
+}
+
 func (cs *CloudState) AnyError() bool {
 	for i := 0; i < len(cs.Nodes); i++ {
 		if cs.Nodes[i].Error != nil || cs.Nodes[i].AnyError() {
@@ -158,22 +251,67 @@ func (cs *CloudState) AnyError() bool {
 	return false
 }
 
+// StopAndWait stops the instances in the reverse order of starting and waits
+// for the attached containers to exit.
 func (cs *CloudState) StopAndWait() {
-	for i := 0; i < len(cs.Nodes); i++ {
-		ns := &cs.Nodes[i]
-		for j := 0; j < len(ns.Instances); j++ {
-			ns.Instances[j].stop()
+	cs.teardown(func(is *InstanceState) {
+		is.stop()
+	})
+	cs.WaitGroup.Wait()
+	if (cs.Env.RunFlags & Remove) != 0 {
+		for i := 0; i < len(cs.Nodes); i++ {
+			ns := &cs.Nodes[i]
+			for j := 0; j < len(ns.Instances); j++ {
+				ns.Instances[j].remove()
+			}
 		}
 	}
-	cs.WaitGroup.Wait()
 }
 
 func (il *ImageLoader) Load() {
 	il.Logger.Info("Loading image")
-	il.Error = Docker(il.State.Env, il.Logger).Pull(il.Name)
+	il.Error = Docker(il.State.Env, il.Logger).WithContext(il.State.ctx).Pull(il.Name)
 }
 
 func (ce *CloudEnv) Run() *CloudState {
+	cs := ce.NewState()
+	cs.Run()
+	return cs
+}
+
+// Run starts all the nodes and waits until they complete.
+func (cs *CloudState) Run() {
+	cs.Env.Logger.Info("Starting cluster %s", cs.Env.Cluster.Name)
+
+	var wg sync.WaitGroup
+	for i := 0; i < len(cs.Nodes); i++ {
+		ns := &cs.Nodes[i]
+		ns.initInstances(ns.Node.Instances)
+		wg.Add(1)
+	}
+	for i := 0; i < len(cs.Nodes); i++ {
+		go func(ns *NodeState) {
+			err := ns.run(cs)
+			if err != nil && cs.Aborted() {
+				err = errorAborted
+			}
+			if err != nil {
+				ns.Logger.Error("%v", err)
+			}
+			cs.fail(err)
+			cs.Lock()
+			ns.Error = err
+			ns.Stopped = true
+			cs.Notify()
+			cs.Unlock()
+			wg.Done()
+		}(&cs.Nodes[i])
+	}
+	wg.Wait()
+}
+
+// NewState creates the state of the cluster without starting it.
+func (ce *CloudEnv) NewState() *CloudState {
 	cs := &CloudState{
 		Env:    ce,
 		Images: make(map[string]*ImageLoader),
@@ -182,66 +320,125 @@ func (ce *CloudEnv) Run() *CloudState {
 	}
 
 	cs.stateDir = path.Join(ce.DataDir, states, ce.Cluster.Name)
-	cs.workspace = path.Join(workspace, states, ce.Cluster.Name)
 
 	cs.cond = sync.NewCond(&cs.lock)
+	cs.ctx, cs.cancel = context.WithCancel(context.Background())
 
 	cs.vars.UpdateVar("project", ce.Cluster.Name)
 	cs.vars.UpdateVar("cluster", ce.Cluster.Name)
 	cs.vars.UpdateVar("container", "docker")
 	cs.vars.UpdateVar("os", "linux")
 
-	ce.Logger.Info("Starting cluster %s", ce.Cluster.Name)
-
-	var wg sync.WaitGroup
 	for i := 0; i < len(cs.Nodes); i++ {
 		ns := &cs.Nodes[i]
 		ns.State = cs
 		ns.Node = &ce.Cluster.Nodes[i]
+		ns.Logger = ce.Logger.NewLogger(ns.Node.Name)
 		ns.LocalVars = LocalVarsRepo()
-		ns.Instances = make([]InstanceState, ns.Node.Instances)
-		for j := 0; j < len(ns.Instances); j++ {
-			is := &ns.Instances[j]
-			is.NodeState = ns
-			is.Index = uint(j)
-			is.LocalVars = LocalVarsRepo()
-		}
-		wg.Add(1)
+		ns.LocalVars.UpdateVar("template", ns.Node.Name)
 	}
-	for i := 0; i < len(cs.Nodes); i++ {
-		go func(ns *NodeState) {
-			if ns.Error = ns.run(cs); ns.Error != nil {
-				ns.Logger.Error("%v", ns.Error)
+	return cs
+}
+
+func (ns *NodeState) initInstances(count uint) {
+	ns.Instances = make([]InstanceState, count)
+	for j := 0; j < len(ns.Instances); j++ {
+		ns.Instances[j].init(ns, uint(j))
+	}
+	ns.LocalVars.UpdateVar("instances", fmt.Sprintf("%v", len(ns.Instances)))
+}
+
+func (is *InstanceState) init(ns *NodeState, index uint) {
+	is.NodeState = ns
+	is.Index = index
+	is.LocalVars = LocalVarsRepo()
+	is.LocalVars.UpdateVar("instance", is.Ref())
+	is.LocalVars.UpdateVar("index", fmt.Sprintf("%v", index))
+	is.Logger = ns.Logger.NewLogger(is.name())
+	is.cidfile = path.Join(ns.State.stateDir, is.name()+".cid")
+}
+
+func (ns *NodeState) run(cs *CloudState) error {
+	if err := ns.setup(); err != nil {
+		return err
+	}
+	if err := ns.waitDependencies(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	batches := ns.batches()
+	for n, batch := range batches {
+		if n > 0 {
+			if err := ns.waitBatch(batches[n-1]); err != nil {
+				for _, rest := range batches[n:] {
+					for _, is := range rest {
+						is.setStopped(err)
+					}
+				}
+				break
 			}
-			ns.Stopped = true
-			cs.Notify()
-			wg.Done()
-		}(&cs.Nodes[i])
+		}
+		for _, is := range batch {
+			wg.Add(1)
+			go func(is *InstanceState) {
+				err := is.run(ns, is.Index)
+				if err != nil && cs.Aborted() {
+					err = errorAborted
+				}
+				if err != nil {
+					is.Logger.Error("%v", err)
+				}
+				is.setStopped(err)
+				cs.fail(err)
+				wg.Done()
+			}(is)
+		}
 	}
 	wg.Wait()
-	return cs
+
+	return nil
 }
 
-func (ns *NodeState) run(cs *CloudState) error {
+// setup resolves the image and builds DockerArgs for creating containers.
+func (ns *NodeState) setup() error {
+	cs := ns.State
 	if err := os.MkdirAll(cs.stateDir, 0777); err != nil && !os.IsExist(err) {
 		return err
 	}
 
 	varCtx := &VarContext{Cloud: ns.State, Node: ns}
 
-	ns.LocalVars.UpdateVar("template", ns.Node.Name)
-	ns.LocalVars.UpdateVar("instances", fmt.Sprintf("%v", len(ns.Instances)))
 	ns.Image = cs.Substitute(ns.Node.Image, varCtx)
 	ns.LocalVars.UpdateVar("image", ns.Image)
 	cs.Notify()
 
-	ns.DockerArgs = []string{"-v", cs.Env.DataDir + ":" + workspace, "-w", workspace}
-	ns.Logger = cs.Env.Logger.NewLogger(ns.Node.Name)
-
-	if err := cs.LoadImage(ns.Node.Image); err != nil {
+	if cs.Aborted() {
+		return errorAborted
+	}
+	if err := cs.LoadImage(ns.Image); err != nil {
 		return err
 	}
 
+	ns.buildDockerArgs(varCtx)
+
+	if (ns.State.Env.RunFlags & Prepare) != 0 {
+		if err := ns.prepareNode(); err != nil {
+			return err
+		}
+	} else {
+		ns.usePreparedImage()
+	}
+
+	ns.appendImageArgs()
+	return nil
+}
+
+// buildDockerArgs builds the arguments for creating containers excluding
+// the image and command.
+func (ns *NodeState) buildDockerArgs(varCtx *VarContext) {
+	cs := ns.State
+	ns.DockerArgs = []string{"-v", cs.Env.DataDir + ":" + workspace, "-w", workspace}
 	if ns.Node.Docker.Privileged {
 		ns.DockerArgs = append(ns.DockerArgs, "--privileged")
 	}
@@ -267,38 +464,19 @@ func (ns *NodeState) run(cs *CloudState) error {
 		ns.DockerArgs = append(ns.DockerArgs, "-v")
 		ns.DockerArgs = append(ns.DockerArgs, volMap)
 	}
+}
 
-	if (ns.State.Env.RunFlags & Prepare) != 0 {
-		if err := ns.prepareNode(); err != nil {
-			return err
-		}
-	}
+// docker returns the docker wrapper whose commands are killed when the
+// cluster is aborted.
+func (ns *NodeState) docker() *docker {
+	return Docker(ns.State.Env, ns.Logger).WithContext(ns.State.ctx)
+}
 
+func (ns *NodeState) appendImageArgs() {
 	ns.DockerArgs = append(ns.DockerArgs, ns.Image)
 	for _, cmd := range ns.Node.Docker.Cmd {
 		ns.DockerArgs = append(ns.DockerArgs, cmd)
 	}
-
-	var wg sync.WaitGroup
-	for i := 0; i < len(ns.Instances); i++ {
-		wg.Add(1)
-		go func(index uint, is *InstanceState) {
-			if is.Error = is.run(ns, index); is.Error != nil {
-				is.Logger.Error("%v", is.Error)
-			}
-			is.Stopped = true
-			cs.Notify()
-			wg.Done()
-		}(uint(i), &ns.Instances[i])
-	}
-	wg.Wait()
-
-	return nil
-}
-
-func (ns *NodeState) prepareNode() error {
-	// TODO
-	return nil
 }
 
 func (ns *NodeState) AnyError() bool {
@@ -311,30 +489,19 @@ func (ns *NodeState) AnyError() bool {
 }
 
 func (is *InstanceState) run(ns *NodeState, index uint) (err error) {
-	name := fmt.Sprintf("%s.%v", ns.Node.Name, index)
-	runDir := path.Join(ns.State.stateDir, name+".run")
-	localScript := path.Join(runDir, "cmd.sh")
-	remoteScript := path.Join(ns.State.workspace, name+".run", "cmd.sh")
-	remoteWrapper := path.Join(ns.State.workspace, name+".run", "run.sh")
-
-	is.Logger = ns.Logger.NewLogger(name)
-	is.cidfile = path.Join(ns.State.stateDir, name+".cid")
-
-	runCmds := (ns.State.Env.RunFlags & Run) != 0
-	if runCmds {
-		if err := os.MkdirAll(runDir, 0777); err != nil {
-			return err
-		}
-		if err := ioutil.WriteFile(path.Join(runDir, "run.sh"),
-			[]byte("#!/bin/sh\n"+
-				remoteScript+"\necho $?>"+remoteScript+".exit\n"+
-				"chmod 0777 "+remoteScript+".exit"), 0777); err != nil {
-			return err
-		}
+	if ns.State.Aborted() {
+		return errorAborted
 	}
+	ns.State.Lock()
+	is.Ready = false
+	ns.State.Unlock()
 	is.Logger.Info("Spawning instance")
-	if is.ContainerId, err = is.docker().Create(is.cidfile, ns.DockerArgs); err != nil {
+	// killing the client may leave the container created without the
+	// cidfile, so create isn't cancelled and the abort is checked after
+	if is.ContainerId, err = is.cleanupDocker().Create(is.cidfile, ns.DockerArgs); err != nil {
 		return err
+	} else if ns.State.Aborted() {
+		return errorAborted
 	}
 
 	if (ns.State.Env.RunFlags & Detach) != 0 {
@@ -347,17 +514,29 @@ func (is *InstanceState) run(ns *NodeState, index uint) (err error) {
 		return err
 	}
 
-	if ip, err := is.docker().Inspect(is.ContainerId, "{{.NetworkSettings.IPAddress}}"); err == nil {
-		is.LocalVars.UpdateVar("ip", ip)
-	}
-	if mac, err := is.docker().Inspect(is.ContainerId, "{{.NetworkSettings.MacAddress}}"); err == nil {
-		is.LocalVars.UpdateVar("mac", mac)
-	}
+	is.publishAddresses()
 	is.NodeState.State.Notify()
 
-	if runCmds {
-		if err = is.runCommands("run", remoteWrapper, localScript, remoteScript); err == nil {
-			err = is.capture()
+	if ns.State.Aborted() {
+		return errorAborted
+	}
+	if err = is.runHook("post-start"); err != nil {
+		return err
+	}
+	if err = is.waitReady(ns.State.ctx); err != nil {
+		return err
+	}
+	ns.State.Lock()
+	is.Ready = true
+	ns.State.Notify()
+	ns.State.Unlock()
+
+	if (ns.State.Env.RunFlags & Run) != 0 {
+		err = is.runCommands("run")
+		if captureErr := is.capture(err == nil); err == nil {
+			err = captureErr
+		} else if captureErr != nil {
+			is.Logger.Error("Capture failed: %v", captureErr)
 		}
 	}
 
@@ -370,70 +549,298 @@ func (is *InstanceState) run(ns *NodeState, index uint) (err error) {
 	return
 }
 
+// setStopped marks the instance stopped with the error and wakes up the
+// waiters.
+func (is *InstanceState) setStopped(err error) {
+	cs := is.NodeState.State
+	cs.Lock()
+	is.Error = err
+	is.Stopped = true
+	cs.Notify()
+	cs.Unlock()
+}
+
+func (is *InstanceState) name() string {
+	return fmt.Sprintf("%s.%v", is.NodeState.Node.Name, is.Index)
+}
+
+// Ref returns the name used to reference the instance in variables,
+// e.g. etcd-0 in %(ip:etcd-0).
+func (is *InstanceState) Ref() string {
+	return fmt.Sprintf("%s-%v", is.NodeState.Node.Name, is.Index)
+}
+
+// docker returns the docker wrapper whose commands are killed when the
+// cluster is aborted.
 func (is *InstanceState) docker() *docker {
+	return Docker(is.NodeState.State.Env, is.Logger).WithContext(is.NodeState.State.ctx)
+}
+
+// cleanupDocker returns the docker wrapper for stopping and cleaning up the
+// container, which keeps working after the cluster is aborted.
+func (is *InstanceState) cleanupDocker() *docker {
 	return Docker(is.NodeState.State.Env, is.Logger)
 }
 
-func (is *InstanceState) runCommands(name, remoteWrapper, localScript, remoteScript string) error {
+// commandDocker returns the docker wrapper for running commands, which is
+// not cancelled while running the stop hooks.
+func (is *InstanceState) commandDocker() *docker {
+	if is.stopping {
+		return is.cleanupDocker()
+	}
+	return is.docker()
+}
+
+// dockerOutput is the same as commandDocker but writes the output of
+// commands to stdout and stderr instead of the logger unless they are nil.
+func (is *InstanceState) dockerOutput(stdout, stderr io.Writer) *docker {
+	d := is.commandDocker()
+	if stdout != nil {
+		d.stdout = stdout
+	}
+	if stderr != nil {
+		d.stderr = stderr
+	}
+	return d
+}
+
+// register saves the output of a command in the variable and wakes up the
+// lookups waiting for it.
+func (is *InstanceState) register(name, output string) {
+	is.LocalVars.UpdateVar(name, strings.TrimSpace(output))
+	is.Logger.Debug("REGISTER %s", name)
+	cs := is.NodeState.State
+	cs.Lock()
+	cs.Notify()
+	cs.Unlock()
+}
+
+func (is *InstanceState) publishAddresses() {
+	if ip, err := is.docker().Inspect(is.ContainerId, "{{.NetworkSettings.IPAddress}}"); err == nil {
+		is.LocalVars.UpdateVar("ip", ip)
+	}
+	if mac, err := is.docker().Inspect(is.ContainerId, "{{.NetworkSettings.MacAddress}}"); err == nil {
+		is.LocalVars.UpdateVar("mac", mac)
+	}
+}
+
+func (is *InstanceState) runCommands(name string) error {
+	return is.runCommandsOutput(name, nil, nil)
+}
+
+// runCommandsOutput runs the commands in the named section with the output
+// written to stdout and stderr, or the logger if nil.
+func (is *InstanceState) runCommandsOutput(name string, stdout, stderr io.Writer) error {
 	commands, exists := is.NodeState.Node.Commands[name]
 	if !exists {
 		return nil
 	}
 
-	varCtx := &VarContext{Cloud: is.NodeState.State, Node: is.NodeState, Instance: is}
-	shell := "/bin/bash"
-	if commands.Shell != "" {
-		shell = commands.Shell
+	if err := is.uploadFiles(commands.Files); err != nil {
+		return err
+	}
+
+	return is.runCommandsWith(name, stdout, stderr, is.execCommand)
+}
+
+// commandExecutor runs a single command using d and returns the exit code.
+type commandExecutor func(d *docker, shell, command string, timeout time.Duration) (int, error)
+
+// runCommandsWith substitutes and runs each command in the named section
+// with exec until any command fails. The output goes to the logger if
+// stdout or stderr is nil.
+func (is *InstanceState) runCommandsWith(name string, stdout, stderr io.Writer, exec commandExecutor) error {
+	commands, exists := is.NodeState.Node.Commands[name]
+	if !exists {
+		return nil
 	}
-	for _, command := range commands.Commands {
-		command = is.NodeState.State.Substitute(command, varCtx)
+
+	varCtx := &VarContext{Cloud: is.NodeState.State, Node: is.NodeState, Instance: is}
+	shell := is.NodeState.Node.Shell(name)
+	for n := range commands.Commands {
+		if is.NodeState.State.Aborted() && !is.stopping {
+			return errorAborted
+		}
+		cmd := &commands.Commands[n]
+		command := is.NodeState.State.Substitute(cmd.Command, varCtx)
 		if command = strings.Trim(command, " "); command == "" {
 			continue
 		}
+		if err := is.runCommand(name, cmd, shell, command, stdout, stderr, exec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCommand runs a substituted command, and retries on failure according
+// to the policy of cmd. The result of the last attempt is appended to
+// Results.
+func (is *InstanceState) runCommand(section string, cmd *Command, shell, command string,
+	stdout, stderr io.Writer, exec commandExecutor) error {
+	timeout, retries, delay := time.Duration(*cmd.Timeout), *cmd.Retries, time.Duration(*cmd.RetryDelay)
+	for attempt := uint(0); ; attempt++ {
 		is.Logger.Info("RUN %s", command)
-		if err := os.Remove(localScript + ".exit"); err != nil && !os.IsNotExist(err) {
+		d := is.dockerOutput(stdout, stderr)
+		outBuf, errBuf := d.teeOutput()
+		started := time.Now()
+		exitCode, err := exec(d, shell, command, timeout)
+		result := CommandResult{
+			Section:  section,
+			Command:  command,
+			ExitCode: exitCode,
+			Duration: time.Since(started),
+			Attempts: attempt + 1,
+			Stdout:   outBuf.String(),
+			Stderr:   errBuf.String(),
+		}
+		if err == errorTimeout {
+			err = errors.New(fmt.Sprintf("Timeout after %v: %s", timeout, command))
+		} else if err == nil && exitCode != 0 {
+			err = errors.New(fmt.Sprintf("Exit %v: %s", exitCode, command))
+		} else if err == nil {
+			is.Results = append(is.Results, result)
+			if cmd.Register != "" {
+				is.register(cmd.Register, result.Stdout)
+			}
+			return nil
+		}
+		if attempt >= retries {
+			result.Error = err
+			is.Results = append(is.Results, result)
+			is.Logger.Error("ERR %v", err)
 			return err
 		}
-		if err := ioutil.WriteFile(localScript, []byte("#!"+shell+"\n"+command), 0777); err != nil {
+		is.Logger.Warning("%v, retry %v/%v in %v", err, attempt+1, retries, delay)
+		if is.stopping {
+			time.Sleep(delay)
+		} else if err := is.NodeState.State.sleep(delay); err != nil {
 			return err
 		}
-		if err := is.docker().Exec(is.ContainerId, remoteWrapper); err != nil {
+	}
+}
+
+// uploadFiles copies the files into the container. The files not mapped
+// are placed at the same relative path in the workspace, and skipped if
+// already present through the bind-mount of the data directory.
+func (is *InstanceState) uploadFiles(files []string) error {
+	d := is.commandDocker()
+	for _, file := range files {
+		mapping, err := ParseFileMapping(file)
+		if err != nil {
 			return err
 		}
-		if result, err := ioutil.ReadFile(localScript + ".exit"); err != nil {
+		local := path.Join(is.NodeState.State.Env.DataDir, mapping.Local)
+		remote := mapping.Remote
+		if remote == "" {
+			remote = path.Join(workspace, mapping.Local)
+			if _, err := d.ExecOutput(is.ContainerId, "test", "-e", remote); err == nil {
+				continue
+			}
+		} else if !path.IsAbs(remote) {
+			remote = path.Join(workspace, remote)
+		}
+
+		is.Logger.Info("UPLOAD %s -> %s", mapping.Local, remote)
+		info, err := os.Stat(local)
+		if err != nil {
 			return err
-		} else if exitCode, err := strconv.Atoi(strings.Trim(string(result), " \n\r\t\f")); err != nil {
+		}
+		// the contents of a directory are copied into remote, otherwise
+		// docker nests it in remote if it already exists
+		dir, src := path.Dir(remote), local
+		if info.IsDir() {
+			dir, src = remote, local+"/."
+		}
+		if _, err := d.ExecOutput(is.ContainerId, "mkdir", "-p", dir); err != nil {
 			return err
-		} else if exitCode != 0 {
-			err := errors.New(fmt.Sprintf("Exit %v: %s", exitCode, command))
-			is.Logger.Error("ERR %v", err)
+		}
+		if err := d.CopyTo(is.ContainerId, src, remote); err != nil {
 			return err
 		}
+		if mapping.Mode != 0 {
+			mode := strconv.FormatUint(uint64(mapping.Mode), 8)
+			if _, err := d.ExecOutput(is.ContainerId, "chmod", "-R", mode, remote); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-func (is *InstanceState) capture() error {
-	// TODO
-	return nil
+// Exec runs a command in the instance the same way as the commands in the
+// run section: variables are substituted and the shell of the run section
+// is used. The exit code of the command is returned.
+func (is *InstanceState) Exec(command string, stdout, stderr io.Writer) (int, error) {
+	varCtx := &VarContext{Cloud: is.NodeState.State, Node: is.NodeState, Instance: is}
+	command = is.NodeState.State.Substitute(command, varCtx)
+	// not logged at Info which goes to stdout with the output of the command
+	is.Logger.Debug("EXEC %s", command)
+	return is.execCommand(is.dockerOutput(stdout, stderr), is.NodeState.Node.Shell("run"), command, 0)
+}
+
+// Shell opens an interactive shell in the instance using the shell of the
+// run section, and returns the exit code of the shell.
+func (is *InstanceState) Shell(tty bool) (int, error) {
+	shell := is.NodeState.Node.Shell("run")
+	is.Logger.Info("SHELL %s", shell)
+	return is.docker().ExecInteractive(is.ContainerId, tty, shell)
 }
 
-func (is *InstanceState) stop() {
-	if is.ContainerId != "" {
-		is.Logger.Info("Stopping")
-		is.docker().Stop(is.ContainerId)
+// execCommand runs a single command with the shell in the container using
+// d and returns the exit code. errorTimeout is returned if the command
+// doesn't complete within timeout unless it is zero.
+func (is *InstanceState) execCommand(d *docker, shell, command string, timeout time.Duration) (int, error) {
+	return exitCode(d.ExecTimeout(timeout, is.ContainerId, shell, "-c", command))
+}
+
+func (is *InstanceState) stop() error {
+	if is.ContainerId == "" {
+		return nil
 	}
+	d := is.cleanupDocker()
+	if (is.NodeState.State.Env.RunFlags & Force) != 0 {
+		is.Logger.Info("Killing")
+		return d.Kill(is.ContainerId)
+	}
+	// the hooks still run when interrupted by the user, but are skipped if
+	// the cluster is aborted by a failure
+	running, _ := d.isRunning(is.ContainerId)
+	running = running && !is.NodeState.State.failedFast()
+	is.stopping = true
+	defer func() {
+		is.stopping = false
+	}()
+	if running {
+		if err := is.runHook("pre-stop"); err != nil {
+			is.Logger.Warning("pre-stop: %v", err)
+		}
+	}
+	is.Logger.Info("Stopping")
+	if err := d.Stop(is.ContainerId); err != nil {
+		return err
+	}
+	if running {
+		if err := is.runPostStop(); err != nil {
+			is.Logger.Warning("post-stop: %v", err)
+		}
+	}
+	return nil
 }
 
-func (is *InstanceState) remove() {
-	if is.ContainerId != "" {
-		is.Logger.Info("Removing")
-		is.docker().RmForce(is.ContainerId)
-		if is.cidfile != "" {
-			if os.Remove(is.cidfile) == nil {
-				is.cidfile = ""
-			}
+func (is *InstanceState) remove() error {
+	if is.ContainerId == "" {
+		return nil
+	}
+	is.Logger.Info("Removing")
+	if err := is.cleanupDocker().RmForce(is.ContainerId); err != nil {
+		return err
+	}
+	if is.cidfile != "" {
+		if os.Remove(is.cidfile) == nil {
+			is.cidfile = ""
 		}
-		is.ContainerId = ""
 	}
+	is.ContainerId = ""
+	return nil
 }
@@ -3,6 +3,7 @@ package cargo
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/easeway/go-dynobj"
 	"io/ioutil"
 	"path"
@@ -13,6 +14,11 @@ var (
 	errorClusterNoNodes      = errors.New("Cluster nodes not defined")
 	errorClusterBadNode      = errors.New("Bad node definition")
 	errorClusterBadInstances = errors.New("Bad instances value")
+
+	errorClusterBadStartPolicy = errors.New("Bad start policy, expect parallel, serial or batch: N")
+	errorClusterBadRestart     = errors.New("Bad restart policy, expect never, on-failure or always")
+	errorClusterReservedHook   = errors.New("Hook name is reserved for a lifecycle section")
+	errorClusterBadCaptureWhen = errors.New("Bad capture when value, expect always, success or failure")
 )
 
 func (cs *Clusters) DefaultCluster() *Cluster {
@@ -34,39 +40,77 @@ func (cs *Clusters) ClusterByName(name string) *Cluster {
 	return nil
 }
 
+// ValidateYaml reports all the problems in the cluster definition file.
+// The references between nodes are only checked if the structure is valid.
+func ValidateYaml(filename string) (ValidationErrors, error) {
+	if data, err := ioutil.ReadFile(filename); err != nil {
+		return nil, err
+	} else if doc, err := yamlParse(data); err != nil {
+		return nil, err
+	} else if errs := Validate(doc); len(errs.Errors()) > 0 {
+		return errs, nil
+	} else if raw, err := yamlDecode(doc); err != nil {
+		return nil, err
+	} else if _, err := decodeClusters(raw, filename); err != nil {
+		if refErrs, ok := err.(referenceErrors); ok {
+			for _, refErr := range refErrs {
+				node := lookupPath(doc, refErr.Path)
+				errs = append(errs, &ValidationError{Path: refErr.Path, Line: node.Line, Column: node.Column, Message: refErr.Message})
+			}
+			return errs, nil
+		}
+		return append(errs, &ValidationError{Path: ".", Line: doc.Line, Column: doc.Column, Message: err.Error()}), nil
+	} else {
+		return errs, nil
+	}
+}
+
 func LoadYaml(filename string) (*Clusters, error) {
 	if data, err := ioutil.ReadFile(filename); err != nil {
 		return nil, err
-	} else if raw, err := yamlDecode(data); err != nil {
+	} else if doc, err := yamlParse(data); err != nil {
+		return nil, err
+	} else if errs := Validate(doc).Errors(); len(errs) > 0 {
+		return nil, errs
+	} else if raw, err := yamlDecode(doc); err != nil {
 		return nil, err
 	} else {
-		clusters := &Clusters{}
-		obj := &dynobj.DynObj{Query: &dynobj.DynQuery{Object: raw}}
-		arr := obj.AsAny("clusters")
-		if objs, ok := arr.([]interface{}); ok {
-			clusters.Clusters = make([]Cluster, len(objs))
-			for index, clusterDef := range objs {
-				cluster := &clusters.Clusters[index]
-				if err := decodeCluster(clusterDef, cluster); err != nil {
-					return nil, err
-				} else if cluster.Name == "" {
-					return nil, errorClusterNoName
+		return decodeClusters(raw, filename)
+	}
+}
+
+func decodeClusters(raw interface{}, filename string) (*Clusters, error) {
+	clusters := &Clusters{}
+	obj := &dynobj.DynObj{Query: &dynobj.DynQuery{Object: raw}}
+	arr := obj.AsAny("clusters")
+	if objs, ok := arr.([]interface{}); ok {
+		clusters.Clusters = make([]Cluster, len(objs))
+		for index, clusterDef := range objs {
+			cluster := &clusters.Clusters[index]
+			if err := decodeCluster(clusterDef, cluster); err != nil {
+				if refErrs, ok := err.(referenceErrors); ok {
+					for _, refErr := range refErrs {
+						refErr.Path = fmt.Sprintf("clusters[%v].%s", index, refErr.Path)
+					}
 				}
-			}
-			clusters.Default = obj.AsStr("default")
-		} else {
-			clusters.Clusters = make([]Cluster, 1)
-			cluster := &clusters.Clusters[0]
-			if err := decodeCluster(raw, cluster); err != nil {
 				return nil, err
+			} else if cluster.Name == "" {
+				return nil, errorClusterNoName
 			}
-			// derive name from file name
-			if cluster.Name == "" {
-				cluster.Name = path.Base(filename)
-			}
 		}
-		return clusters, nil
+		clusters.Default = obj.AsStr("default")
+	} else {
+		clusters.Clusters = make([]Cluster, 1)
+		cluster := &clusters.Clusters[0]
+		if err := decodeCluster(raw, cluster); err != nil {
+			return nil, err
+		}
+		// derive name from file name
+		if cluster.Name == "" {
+			cluster.Name = path.Base(filename)
+		}
 	}
+	return clusters, nil
 }
 
 func decodeCluster(raw interface{}, cluster *Cluster) error {
@@ -80,6 +124,12 @@ func decodeCluster(raw interface{}, cluster *Cluster) error {
 				return err
 			}
 		}
+		if _, err := dependencyOrder(cluster.Nodes); err != nil {
+			return err
+		}
+		if err := checkReferences(cluster); err != nil {
+			return err
+		}
 	} else {
 		return errorClusterNoNodes
 	}
@@ -99,20 +149,56 @@ func decodeNode(raw interface{}, node *Node) error {
 	if node.Image, ok = nodeMap["image"].(string); !ok || node.Image == "" {
 		return errorClusterBadNode
 	}
-	if instancesObj, exists := nodeMap["instances"]; !exists {
+	switch instances := nodeMap["instances"].(type) {
+	case nil:
 		node.Instances = 1
-	} else if instances, ok := instancesObj.(uint); !ok {
-		return errorClusterBadInstances
-	} else {
+	case int:
+		if instances < 0 {
+			return errorClusterBadInstances
+		}
+		node.Instances = uint(instances)
+	case uint:
 		node.Instances = instances
+	default:
+		return errorClusterBadInstances
 	}
 
-	if err := decodeCommands(nodeMap, "prepare", node.Commands); err != nil {
+	if ready, exists := nodeMap["ready"]; exists {
+		if err := unmarshal(ready, &node.Ready); err != nil {
+			return err
+		}
+	}
+	if err := decodeStartPolicy(nodeMap["start_policy"], node); err != nil {
 		return err
 	}
-	if err := decodeCommands(nodeMap, "run", node.Commands); err != nil {
+	if err := decodeRestartPolicy(nodeMap["restart"], &node.Restart); err != nil {
 		return err
 	}
+	if deps, exists := nodeMap["depends_on"]; exists {
+		if err := unmarshal(deps, &node.DependsOn); err != nil {
+			return errorClusterBadNode
+		}
+	}
+
+	for _, name := range lifecycleHooks {
+		if err := decodeCommands(nodeMap, name, node.Commands); err != nil {
+			return err
+		}
+	}
+	if hooksObj, exists := nodeMap["hooks"]; exists {
+		hooks, ok := hooksObj.(map[string]interface{})
+		if !ok {
+			return errorClusterBadNode
+		}
+		for name := range hooks {
+			if isLifecycleHook(name) {
+				return errorClusterReservedHook
+			}
+			if err := decodeCommands(hooks, name, node.Commands); err != nil {
+				return err
+			}
+		}
+	}
 
 	if err := decodeDockerProperties(nodeMap["docker"], &node.Docker); err != nil {
 		return err
@@ -134,10 +220,53 @@ func decodeCommands(nodeMap map[string]interface{},
 	} else if err := unmarshal(cmdsObj, cmd); err != nil {
 		return err
 	}
+	cmd.applyDefaults()
 	cmds[name] = cmd
 	return nil
 }
 
+func decodeStartPolicy(raw interface{}, node *Node) error {
+	switch policy := raw.(type) {
+	case nil:
+	case string:
+		if policy == StartSerial {
+			node.StartBatch = 1
+		} else if policy != StartParallel {
+			return errorClusterBadStartPolicy
+		}
+	case map[string]interface{}:
+		var batch struct {
+			Batch uint `json:"batch"`
+		}
+		if err := unmarshal(policy, &batch); err != nil || batch.Batch == 0 {
+			return errorClusterBadStartPolicy
+		}
+		node.StartBatch = batch.Batch
+	default:
+		return errorClusterBadStartPolicy
+	}
+	return nil
+}
+
+func decodeRestartPolicy(raw interface{}, policy *RestartPolicy) error {
+	policy.Policy = RestartNever
+	switch val := raw.(type) {
+	case nil:
+	case string:
+		policy.Policy = val
+	case map[string]interface{}:
+		if err := unmarshal(val, policy); err != nil {
+			return errorClusterBadRestart
+		}
+	default:
+		return errorClusterBadRestart
+	}
+	if policy.Policy != RestartNever && policy.Policy != RestartOnFailure && policy.Policy != RestartAlways {
+		return errorClusterBadRestart
+	}
+	return nil
+}
+
 func decodeDockerProperties(obj interface{}, prop *DockerProperties) error {
 	if obj == nil {
 		return nil
@@ -146,37 +275,68 @@ func decodeDockerProperties(obj interface{}, prop *DockerProperties) error {
 }
 
 func decodeCapture(raw interface{}, capture *Capture) error {
+	capture.When = CaptureSuccess
 	if raw == nil {
 		return nil
 	}
-	if obj, ok := raw.(map[string]interface{}); !ok {
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return errorClusterBadNode
+	}
+	if capture.Archive, ok = obj["archive"].(string); !ok && obj["archive"] != nil {
 		return errorClusterBadNode
-	} else if filesRaw, exists := obj["files"]; !exists {
+	}
+	if when, exists := obj["when"]; exists {
+		if capture.When, ok = when.(string); !ok || !validCaptureWhen(capture.When) {
+			return errorClusterBadCaptureWhen
+		}
+	}
+	if filesRaw, exists := obj["files"]; !exists {
 		return nil
 	} else if files, ok := filesRaw.([]interface{}); !ok {
 		return errorClusterBadNode
 	} else {
 		capture.Files = make([]CaptureFile, len(files))
 		for index, fileObj := range files {
+			file := &capture.Files[index]
 			if fn, ok := fileObj.(string); ok {
-				capture.Files[index].Local = fn
-				capture.Files[index].Remote = fn
+				file.Remote = fn
 			} else if names, ok := fileObj.(map[string]interface{}); ok {
-				local, localOk := names["local"].(string)
 				remote, remoteOk := names["remote"].(string)
-				if !localOk || !remoteOk {
+				local, localOk := names["local"].(string)
+				if !remoteOk || (!localOk && names["local"] != nil) {
 					return errorClusterBadNode
 				}
-				capture.Files[index].Local = local
-				capture.Files[index].Remote = remote
+				file.Local = local
+				file.Remote = remote
+				if when, exists := names["when"]; exists {
+					if file.When, ok = when.(string); !ok || !validCaptureWhen(file.When) {
+						return errorClusterBadCaptureWhen
+					}
+				}
 			} else {
 				return errorClusterBadNode
 			}
+			if file.Local == "" {
+				// globs are captured into the directory
+				if isGlob(file.Remote) {
+					file.Local = path.Join("%(instance)", path.Dir(file.Remote))
+				} else {
+					file.Local = path.Join("%(instance)", file.Remote)
+				}
+			}
+			if file.When == "" {
+				file.When = capture.When
+			}
 		}
 	}
 	return nil
 }
 
+func validCaptureWhen(when string) bool {
+	return when == CaptureAlways || when == CaptureSuccess || when == CaptureFailure
+}
+
 func unmarshal(obj interface{}, out interface{}) error {
 	if encoded, err := json.Marshal(obj); err != nil {
 		return err
@@ -1,3 +1,127 @@
 package cargo
 
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
 
+const (
+	defaultShell = "/bin/bash"
+)
+
+var (
+	errorBadFileMapping = errors.New("Bad file mapping, expect LOCAL[:REMOTE[:MODE]]")
+	errorBadDuration    = errors.New("Bad duration, expect a number of seconds or a value like 30s")
+)
+
+// FileMapping is parsed from an entry of Commands.Files. Local is relative
+// to the data directory, Remote is empty if not mapped and Mode is zero if
+// the mode should not be changed.
+type FileMapping struct {
+	Local  string
+	Remote string
+	Mode   os.FileMode
+}
+
+// Shell returns the shell to run the commands in the named section.
+func (n *Node) Shell(name string) string {
+	if commands, exists := n.Commands[name]; exists && commands.Shell != "" {
+		return commands.Shell
+	}
+	return defaultShell
+}
+
+func ParseFileMapping(spec string) (*FileMapping, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	mapping := &FileMapping{Local: parts[0]}
+	if mapping.Local == "" || path.IsAbs(mapping.Local) {
+		return nil, errorBadFileMapping
+	}
+	if len(parts) > 1 {
+		if mapping.Remote = parts[1]; mapping.Remote == "" {
+			return nil, errorBadFileMapping
+		}
+	}
+	if len(parts) > 2 {
+		mode, err := strconv.ParseUint(parts[2], 8, 32)
+		if err != nil || mode == 0 || mode > 07777 {
+			return nil, errorBadFileMapping
+		}
+		mapping.Mode = os.FileMode(mode)
+	}
+	return mapping, nil
+}
+
+// ParseDuration parses a duration like 30s, or a number of seconds which
+// may be fractional.
+func ParseDuration(spec string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(spec, 64); err == nil {
+		if secs < 0 || math.IsNaN(secs) || math.IsInf(secs, 0) {
+			return 0, errorBadDuration
+		}
+		return time.Duration(secs * float64(time.Second)), nil
+	} else if d, err := time.ParseDuration(spec); err == nil && d >= 0 {
+		return d, nil
+	}
+	return 0, errorBadDuration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var spec interface{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	switch val := spec.(type) {
+	case nil:
+		*d = 0
+	case float64:
+		if val < 0 {
+			return errorBadDuration
+		}
+		*d = Duration(val * float64(time.Second))
+	case string:
+		parsed, err := ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return errorBadDuration
+	}
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (c *Command) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.Command); err == nil {
+		return nil
+	}
+	type command Command
+	return json.Unmarshal(data, (*command)(c))
+}
+
+// applyDefaults fills in the policy of the commands not specified from the
+// section.
+func (c *Commands) applyDefaults() {
+	for n := range c.Commands {
+		cmd := &c.Commands[n]
+		if cmd.Timeout == nil {
+			cmd.Timeout = &c.Timeout
+		}
+		if cmd.Retries == nil {
+			cmd.Retries = &c.Retries
+		}
+		if cmd.RetryDelay == nil {
+			cmd.RetryDelay = &c.RetryDelay
+		}
+	}
+}
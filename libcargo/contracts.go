@@ -1,5 +1,9 @@
 package cargo
 
+import (
+	"time"
+)
+
 type Cluster struct {
 	Name  string
 	Nodes []Node
@@ -13,28 +17,96 @@ type DockerProperties struct {
 	Volumes    []string `json:"volumes"`
 }
 
+// Duration is decoded from a string like 30s or 1m30s, or a number of
+// seconds.
+type Duration time.Duration
+
+// Command is decoded from either a string or an object with the policy
+// overriding the defaults of the section. The policy fields not specified
+// are set to the section defaults after decoding. The trimmed output is saved
+// in the variable named by Register if not empty.
+type Command struct {
+	Command    string    `json:"command"`
+	Timeout    *Duration `json:"timeout"`
+	Retries    *uint     `json:"retries"`
+	RetryDelay *Duration `json:"retry_delay"`
+	Register   string    `json:"register"`
+}
+
 type Commands struct {
-	Files    []string `json:"files"`
-	Shell    string   `json:"shell"`
-	Commands []string `json:"commands"`
+	Files      []string  `json:"files"`
+	Shell      string    `json:"shell"`
+	Timeout    Duration  `json:"timeout"`
+	Retries    uint      `json:"retries"`
+	RetryDelay Duration  `json:"retry_delay"`
+	Commands   []Command `json:"commands"`
 }
 
+// The start policies of nodes. A node with a start policy of batch: N has
+// StartBatch set to N, so the next N instances start after the previous
+// ones are ready. The serial policy is the same as batch: 1, and parallel
+// starts all instances at once with StartBatch of zero.
+const (
+	StartParallel = "parallel"
+	StartSerial   = "serial"
+)
+
+const (
+	CaptureAlways  = "always"
+	CaptureSuccess = "success"
+	CaptureFailure = "failure"
+)
+
 type CaptureFile struct {
 	Local  string
 	Remote string
+	When   string
 }
 
 type Capture struct {
-	Files []CaptureFile
+	Files   []CaptureFile
+	Archive string
+	When    string
+}
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// RestartPolicy decides whether an exited container is restarted while the
+// cluster is supervised. The delay before restarting starts from Backoff and
+// doubles after each attempt. There is no limit if MaxAttempts is zero.
+type RestartPolicy struct {
+	Policy      string   `json:"policy"`
+	MaxAttempts uint     `json:"max_attempts"`
+	Backoff     Duration `json:"backoff"`
+}
+
+// ReadyProbe checks whether an instance is ready for the dependents. All the
+// probes specified must succeed. Http is either a URL or PORT/PATH on the
+// instance. Timeout limits the whole wait, and ProbeTimeout each attempt.
+type ReadyProbe struct {
+	Tcp          uint     `json:"tcp"`
+	Http         string   `json:"http"`
+	Command      string   `json:"command"`
+	Interval     Duration `json:"interval"`
+	Timeout      Duration `json:"timeout"`
+	ProbeTimeout Duration `json:"probe_timeout"`
 }
 
 type Node struct {
-	Name      string
-	Instances uint
-	Image     string
-	Docker    DockerProperties
-	Commands  map[string]*Commands
-	Capture   Capture
+	Name       string
+	Instances  uint
+	Image      string
+	DependsOn  []string
+	StartBatch uint
+	Docker     DockerProperties
+	Ready      ReadyProbe
+	Restart    RestartPolicy
+	Commands   map[string]*Commands
+	Capture    Capture
 }
 
 type Clusters struct {
@@ -0,0 +1,170 @@
+package cargo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// dependencyOrder sorts the nodes so that every node comes after the nodes
+// it depends on, and returns the indices. The original order is kept among
+// the nodes without dependencies in between.
+func dependencyOrder(nodes []Node) ([]int, error) {
+	indices := make(map[string]int)
+	for index, node := range nodes {
+		indices[node.Name] = index
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(nodes))
+	order := make([]int, 0, len(nodes))
+	path := make([]string, 0, len(nodes))
+
+	var visit func(index int) error
+	visit = func(index int) error {
+		node := &nodes[index]
+		switch marks[index] {
+		case visited:
+			return nil
+		case visiting:
+			for n, name := range path {
+				if name == node.Name {
+					return errors.New("Dependency cycle: " +
+						strings.Join(append(path[n:], node.Name), " -> "))
+				}
+			}
+		}
+		marks[index] = visiting
+		path = append(path, node.Name)
+		for _, name := range node.DependsOn {
+			dep, exists := indices[name]
+			if !exists {
+				return errors.New(fmt.Sprintf("Node %s depends on unknown node %s", node.Name, name))
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[0 : len(path)-1]
+		marks[index] = visited
+		order = append(order, index)
+		return nil
+	}
+
+	for index := range nodes {
+		if err := visit(index); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// waitDependencies waits until all the instances of the nodes depended on
+// are ready. It fails if any of them fails.
+func (ns *NodeState) waitDependencies() error {
+	for _, name := range ns.Node.DependsOn {
+		dep := ns.State.NodeByName(name)
+		if dep == nil {
+			return errors.New("Unknown dependency " + name)
+		}
+		ns.Logger.Info("Waiting for %s", name)
+		if err := dep.waitReady(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ns *NodeState) waitReady() error {
+	instances := make([]*InstanceState, len(ns.Instances))
+	for j := 0; j < len(ns.Instances); j++ {
+		instances[j] = &ns.Instances[j]
+	}
+	if failed, err := ns.State.waitInstancesReady(instances); err != nil {
+		return err
+	} else if failed != nil {
+		return errors.New("Dependency " + failed.Ref() + " failed")
+	}
+	return nil
+}
+
+// waitBatch waits until all the instances of the previous batch are ready.
+func (ns *NodeState) waitBatch(batch []*InstanceState) error {
+	if failed, err := ns.State.waitInstancesReady(batch); err != nil {
+		return err
+	} else if failed != nil {
+		return errors.New("Instance " + failed.Ref() + " in the previous batch failed")
+	}
+	return nil
+}
+
+// waitInstancesReady waits until all the instances are ready, and returns
+// the first instance failed or stopped before being ready.
+func (cs *CloudState) waitInstancesReady(instances []*InstanceState) (*InstanceState, error) {
+	cs.Lock()
+	defer cs.Unlock()
+	for !cs.Aborted() {
+		ready := true
+		for _, is := range instances {
+			if is.Error != nil || ((is.Stopped || is.NodeState.Stopped) && !is.Ready) {
+				return is, nil
+			} else if !is.Ready {
+				ready = false
+			}
+		}
+		if ready {
+			return nil, nil
+		}
+		cs.Wait()
+	}
+	return nil, errorAborted
+}
+
+// batches splits the instances by the start policy of the node.
+func (ns *NodeState) batches() [][]*InstanceState {
+	size := ns.Node.StartBatch
+	if size == 0 || size > uint(len(ns.Instances)) {
+		size = uint(len(ns.Instances))
+	}
+	batches := make([][]*InstanceState, 0)
+	for j := uint(0); j < uint(len(ns.Instances)); j++ {
+		if j%size == 0 {
+			batches = append(batches, make([]*InstanceState, 0, size))
+		}
+		batches[len(batches)-1] = append(batches[len(batches)-1], &ns.Instances[j])
+	}
+	return batches
+}
+
+// teardown calls fn for the instances in the reverse order of starting: the
+// dependents before the nodes they depend on, and the batches of instances
+// from the last one. The instances in the same batch are handled in
+// parallel.
+func (cs *CloudState) teardown(fn func(is *InstanceState)) {
+	order, err := dependencyOrder(cs.Env.Cluster.Nodes)
+	if err != nil {
+		order = make([]int, len(cs.Nodes))
+		for i := range order {
+			order[i] = i
+		}
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		batches := cs.Nodes[order[i]].batches()
+		for n := len(batches) - 1; n >= 0; n-- {
+			var wg sync.WaitGroup
+			for _, is := range batches[n] {
+				wg.Add(1)
+				go func(is *InstanceState) {
+					fn(is)
+					wg.Done()
+				}(is)
+			}
+			wg.Wait()
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package cargo
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -18,15 +21,33 @@ const (
 )
 
 var (
-	cmdSeq            int32 = 0
-	errorStartTimeout       = errors.New("Start timeout")
+	cmdSeq               int32 = 0
+	errorStartTimeout          = errors.New("Start timeout")
+	errorTimeout               = errors.New("Timeout")
+	errorNoSuchContainer       = errors.New("No such container")
 )
 
+type ContainerInfo struct {
+	Id    string
+	State struct {
+		Status     string
+		Running    bool
+		ExitCode   int
+		StartedAt  time.Time
+		FinishedAt time.Time
+	}
+	NetworkSettings struct {
+		IPAddress  string
+		MacAddress string
+	}
+}
+
 type docker struct {
 	seq    string
 	logger Logger
 	stdout io.Writer
 	stderr io.Writer
+	ctx    context.Context
 }
 
 func Docker(env *CloudEnv, logger Logger) *docker {
@@ -36,12 +57,28 @@ func Docker(env *CloudEnv, logger Logger) *docker {
 		logger: logger,
 		stdout: LoggerWriter(logger, seq+".&1| "),
 		stderr: LoggerWriter(logger, seq+".&2| "),
+		ctx:    context.Background(),
 	}
 }
 
+// WithContext makes the commands killed when ctx is done.
+func (d *docker) WithContext(ctx context.Context) *docker {
+	d.ctx = ctx
+	return d
+}
+
+// teeOutput additionally writes the output of the commands to the returned
+// buffers.
+func (d *docker) teeOutput() (stdout, stderr *bytes.Buffer) {
+	stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+	d.stdout = io.MultiWriter(d.stdout, stdout)
+	d.stderr = io.MultiWriter(d.stderr, stderr)
+	return
+}
+
 func (d *docker) cmdBase(arg ...string) *exec.Cmd {
 	d.logger.Debug("DOCKER.%s %v", d.seq, arg)
-	cmd := exec.Command(executable, arg...)
+	cmd := exec.CommandContext(d.ctx, executable, arg...)
 	return cmd
 }
 
@@ -69,19 +106,74 @@ func (d *docker) isRunning(cid string) (bool, error) {
 	return running == "true", err
 }
 
+// Inspect returns errorNoSuchContainer if docker doesn't know the
+// container, and other errors if it can't tell.
 func (d *docker) Inspect(cid, fmt string) (string, error) {
-	return d.cmdOutput("inspect", "-f", fmt, cid)
+	return d.inspect("-f", fmt, cid)
+}
+
+func (d *docker) InspectContainer(cid string) (*ContainerInfo, error) {
+	out, err := d.inspect(cid)
+	if err != nil {
+		return nil, err
+	}
+	var infos []ContainerInfo
+	if err = json.Unmarshal([]byte(out), &infos); err != nil {
+		return nil, err
+	} else if len(infos) == 0 {
+		return nil, errorNoSuchContainer
+	}
+	return &infos[0], nil
+}
+
+func (d *docker) inspect(arg ...string) (string, error) {
+	out, err := d.cmdOutput(append([]string{"inspect"}, arg...)...)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if bytes.Contains(exitErr.Stderr, []byte("No such object")) ||
+			bytes.Contains(exitErr.Stderr, []byte("No such container")) {
+			return "", errorNoSuchContainer
+		}
+		if msg := strings.TrimSpace(string(exitErr.Stderr)); msg != "" {
+			return "", errors.New(msg)
+		}
+	}
+	return out, err
+}
+
+func (d *docker) Logs(cid string, stdout, stderr io.Writer, opts ...string) error {
+	args := append([]string{"logs"}, opts...)
+	cmd := d.cmdBase(append(args, cid)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+func (d *docker) InspectImage(image, fmt string) (string, error) {
+	return d.cmdOutput("inspect", "--type=image", "-f", fmt, image)
 }
 
 func (d *docker) Pull(image string) error {
 	return d.cmd("pull", image).Run()
 }
 
+func (d *docker) Push(image string) error {
+	return d.cmd("push", image).Run()
+}
+
+func (d *docker) Commit(cid, image string, changes ...string) error {
+	args := []string{"commit"}
+	for _, change := range changes {
+		args = append(args, "--change", change)
+	}
+	return d.cmd(append(args, cid, image)...).Run()
+}
+
 func (d *docker) Create(cidfile string, args []string) (string, error) {
-	cmdArgs := make([]string, len(args)+2)
-	copy(cmdArgs[2:], args)
-	cmdArgs[0] = "create"
-	cmdArgs[1] = "--cidfile=" + cidfile
+	if cidfile == "" {
+		return d.cmdOutput(append([]string{"create"}, args...)...)
+	}
+
+	cmdArgs := []string{"create", "--cidfile=" + cidfile}
 
 	cid := ""
 	if cidBytes, err := ioutil.ReadFile(cidfile); err == nil {
@@ -93,11 +185,13 @@ func (d *docker) Create(cidfile string, args []string) (string, error) {
 			if running {
 				d.Stop(cid)
 			}
+			// the flags must precede the image in args
 			cmdArgs = append(cmdArgs, "--volumes-from="+cid)
 		} else {
 			cid = ""
 		}
 	}
+	cmdArgs = append(cmdArgs, args...)
 
 	if err := os.Remove(cidfile); err != nil && !os.IsNotExist(err) {
 		return "", err
@@ -126,7 +220,8 @@ func (d *docker) Start(cid string, wg *sync.WaitGroup) error {
 	if wg == nil {
 		return d.cmd(args...).Run()
 	} else {
-		cmd := d.cmd(args...)
+		// the attached client lives until the container exits
+		cmd := d.background().cmd(args...)
 		if err := cmd.Start(); err != nil {
 			return err
 		}
@@ -150,6 +245,10 @@ func (d *docker) Stop(cid string) error {
 	return d.cmd("stop", cid).Run()
 }
 
+func (d *docker) Kill(cid string) error {
+	return d.cmd("kill", cid).Run()
+}
+
 func (d *docker) Remove(cid string) error {
 	return d.cmd("rm", cid).Run()
 }
@@ -158,6 +257,55 @@ func (d *docker) RmForce(cid string) error {
 	return d.cmd("rm", "--force", cid).Run()
 }
 
+// ExecInteractive runs a command in the container attached to the standard
+// input and output of the current process, and returns the exit code.
+func (d *docker) ExecInteractive(cid string, tty bool, args ...string) (int, error) {
+	cmdArgs := []string{"exec", "-i"}
+	if tty {
+		cmdArgs = append(cmdArgs, "-t")
+	}
+	cmdArgs = append(cmdArgs, cid)
+	cmd := d.cmdBase(append(cmdArgs, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return exitCode(cmd.Run())
+}
+
+// exitCode extracts the exit code if the command ran but failed.
+func exitCode(err error) (int, error) {
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (d *docker) ExecOutput(cid string, args ...string) (string, error) {
+	return d.cmdOutput(append([]string{"exec", cid}, args...)...)
+}
+
+// RunTemp runs a command in a temporary container which is removed after
+// exit, and returns the exit code.
+func (d *docker) RunTemp(timeout time.Duration, args ...string) (int, error) {
+	name := fmt.Sprintf("cargo-temp-%d-%s", os.Getpid(), d.seq)
+	err := d.runTimeout(timeout, append([]string{"run", "--rm", "--name", name}, args...)...)
+	if err == errorTimeout || err == errorAborted {
+		// killing the client leaves the container running
+		d.background().RmForce(name)
+	}
+	return exitCode(err)
+}
+
+func (d *docker) CopyFrom(cid, remote, local string) error {
+	return d.cmd("cp", cid+":"+remote, local).Run()
+}
+
+func (d *docker) CopyTo(cid, local, remote string) error {
+	return d.cmd("cp", local, cid+":"+remote).Run()
+}
+
 func (d *docker) Exec(cid string, args ...string) error {
 	cmdArgs := make([]string, len(args)+2)
 	cmdArgs[0] = "exec"
@@ -165,3 +313,54 @@ func (d *docker) Exec(cid string, args ...string) error {
 	copy(cmdArgs[2:], args)
 	return d.cmd(cmdArgs...).Run()
 }
+
+// ExecTimeout is the same as Exec but returns errorTimeout if the command
+// doesn't complete within timeout. There is no limit if timeout is zero.
+// Killing the docker client doesn't stop the command inside the container,
+// so args[0], which must be a shell, records the pid of the command to kill
+// it afterwards.
+func (d *docker) ExecTimeout(timeout time.Duration, cid string, args ...string) error {
+	if timeout <= 0 || len(args) == 0 {
+		return d.runTimeout(timeout, append([]string{"exec", cid}, args...)...)
+	}
+	pidfile := fmt.Sprintf("/tmp/.cargo-exec-%d-%s.pid", os.Getpid(), d.seq)
+	arg := []string{"exec", cid, args[0], "-c", "echo $$ >" + pidfile + "; exec \"$@\"", args[0]}
+	err := d.runTimeout(timeout, append(arg, args...)...)
+	script := "rm -f " + pidfile
+	if err == errorTimeout || err == errorAborted {
+		script = "kill -KILL -$(cat " + pidfile + ") 2>/dev/null || kill -KILL $(cat " + pidfile + "); " + script
+	}
+	d.background().cmd("exec", cid, args[0], "-c", script).Run()
+	return err
+}
+
+// background returns a client for the same container which isn't killed by
+// the context, used to clean up after a timeout or an abort.
+func (d *docker) background() *docker {
+	dup := *d
+	dup.ctx = context.Background()
+	return &dup
+}
+
+// runTimeout runs the command and returns errorTimeout if it is killed by
+// the timeout, or errorAborted by the context.
+func (d *docker) runTimeout(timeout time.Duration, arg ...string) error {
+	ctx, cancel := d.ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(d.ctx, timeout)
+		d.logger.Debug("DOCKER.%s %v (timeout %v)", d.seq, arg, timeout)
+	} else {
+		d.logger.Debug("DOCKER.%s %v", d.seq, arg)
+	}
+	defer cancel()
+	cmd := exec.CommandContext(ctx, executable, arg...)
+	cmd.Stdout = d.stdout
+	cmd.Stderr = d.stderr
+	err := cmd.Run()
+	if d.ctx.Err() != nil {
+		return errorAborted
+	} else if ctx.Err() == context.DeadlineExceeded {
+		return errorTimeout
+	}
+	return err
+}
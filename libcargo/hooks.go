@@ -0,0 +1,96 @@
+package cargo
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// lifecycleHooks are the command sections defined directly on nodes. The
+// other named sets are defined under hooks and only run on demand.
+var lifecycleHooks = []string{"prepare", "run", "post-start", "pre-stop", "post-stop"}
+
+// isLifecycleHook tells whether name is reserved for a lifecycle section.
+func isLifecycleHook(name string) bool {
+	for _, hook := range lifecycleHooks {
+		if hook == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runHook runs the named set of commands if defined on the node.
+func (is *InstanceState) runHook(name string) error {
+	if _, exists := is.NodeState.Node.Commands[name]; !exists {
+		return nil
+	}
+	is.Logger.Info("HOOK %s", name)
+	return is.runCommands(name)
+}
+
+// runPostStop runs the post-stop commands after the container is stopped.
+// As the container is no longer running, each command runs in a temporary
+// container from the same image with the volumes of the stopped container.
+func (is *InstanceState) runPostStop() error {
+	if _, exists := is.NodeState.Node.Commands["post-stop"]; !exists {
+		return nil
+	}
+	is.Logger.Info("HOOK post-stop")
+	image, err := is.cleanupDocker().Inspect(is.ContainerId, "{{.Image}}")
+	if err != nil {
+		return err
+	}
+	dataDir := is.NodeState.State.Env.DataDir
+	return is.runCommandsWith("post-stop", nil, nil, func(d *docker, shell, command string, timeout time.Duration) (int, error) {
+		return d.RunTemp(timeout, "--volumes-from", is.ContainerId,
+			"-v", dataDir+":"+workspace, "-w", workspace,
+			"--entrypoint", shell, image, "-c", command)
+	})
+}
+
+// RunHook runs the named set of commands in the instances of the nodes
+// defining it in parallel. If there are more than one instance, each line of
+// the output is prefixed by the instance reference. The failures are kept in
+// Error of the instances.
+func (cs *CloudState) RunHook(name string, instances []*InstanceState, stdout, stderr io.Writer) error {
+	selected := make([]*InstanceState, 0, len(instances))
+	for _, is := range instances {
+		if _, exists := is.NodeState.Node.Commands[name]; exists {
+			selected = append(selected, is)
+		}
+	}
+	if len(selected) == 0 {
+		return errors.New("Hook not defined: " + name)
+	}
+
+	if len(selected) == 1 {
+		selected[0].runHookOutput(name, stdout, stderr)
+		return nil
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	prefixes := instancePrefixes(selected)
+	for n, is := range selected {
+		wg.Add(1)
+		go func(n int, is *InstanceState) {
+			outWriter := PrefixWriter(stdout, prefixes[n], &lock)
+			errWriter := PrefixWriter(stderr, prefixes[n], &lock)
+			is.runHookOutput(name, outWriter, errWriter)
+			outWriter.Close()
+			errWriter.Close()
+			wg.Done()
+		}(n, is)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (is *InstanceState) runHookOutput(name string, stdout, stderr io.Writer) {
+	is.Logger.Info("HOOK %s", name)
+	if is.Error = is.runCommandsOutput(name, stdout, stderr); is.Error != nil {
+		is.Logger.Error("%v", is.Error)
+	}
+}
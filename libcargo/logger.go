@@ -1,9 +1,11 @@
 package cargo
 
 import (
+	"bytes"
 	"github.com/op/go-logging"
 	"io"
 	"strings"
+	"sync"
 )
 
 type goLogger struct {
@@ -45,18 +47,63 @@ func (l *goLogger) Trace(fmt string, args ...interface{}) {
 	l.Logger.Debug(fmt, args...)
 }
 
+// logWriter writes each line with prefix either to logger, or to out
+// under lock so writers sharing the same lock never interleave their lines.
+// When writing to out, only complete lines are written and the last
+// incomplete line is written on Close.
 type logWriter struct {
 	logger Logger
+	out    io.Writer
 	prefix string
+	lock   sync.Locker
+	buf    []byte
 }
 
 func LoggerWriter(logger Logger, prefix string) io.Writer {
 	return &logWriter{logger: logger, prefix: prefix}
 }
 
+// PrefixWriter writes each line to out with prefix.
+func PrefixWriter(out io.Writer, prefix string, lock sync.Locker) io.WriteCloser {
+	return &logWriter{out: out, prefix: prefix, lock: lock}
+}
+
 func (lw *logWriter) Write(p []byte) (int, error) {
-	for _, line := range strings.Split(string(p), "\n") {
-		lw.logger.Trace("%s%s", lw.prefix, line)
+	if lw.out == nil {
+		return len(p), lw.writeLines(strings.Split(strings.TrimSuffix(string(p), "\n"), "\n"))
+	}
+	lw.buf = append(lw.buf, p...)
+	pos := bytes.LastIndexByte(lw.buf, '\n')
+	if pos < 0 {
+		return len(p), nil
+	}
+	lines := strings.Split(string(lw.buf[0:pos]), "\n")
+	lw.buf = lw.buf[pos+1:]
+	return len(p), lw.writeLines(lines)
+}
+
+func (lw *logWriter) Close() error {
+	if len(lw.buf) == 0 {
+		return nil
+	}
+	line := string(lw.buf)
+	lw.buf = nil
+	return lw.writeLines([]string{line})
+}
+
+func (lw *logWriter) writeLines(lines []string) error {
+	if lw.logger != nil {
+		for _, line := range lines {
+			lw.logger.Trace("%s%s", lw.prefix, line)
+		}
+		return nil
+	}
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	for _, line := range lines {
+		if _, err := io.WriteString(lw.out, lw.prefix+line+"\n"); err != nil {
+			return err
+		}
 	}
-	return len(p), nil
+	return nil
 }
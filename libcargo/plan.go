@@ -0,0 +1,173 @@
+package cargo
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type InstancePlan struct {
+	Name       string              `json:"name"`
+	CreateArgs []string            `json:"create"`
+	Commands   map[string][]string `json:"commands"`
+}
+
+type NodePlan struct {
+	Name      string         `json:"name"`
+	Image     string         `json:"image"`
+	BaseImage string         `json:"base_image,omitempty"`
+	DependsOn []string       `json:"depends_on"`
+	Volumes   []string       `json:"volumes"`
+	Prepare   []string       `json:"prepare"`
+	Instances []InstancePlan `json:"instances"`
+}
+
+type Plan struct {
+	Cluster string     `json:"cluster"`
+	DataDir string     `json:"datadir"`
+	Nodes   []NodePlan `json:"nodes"`
+}
+
+// Plan resolves everything needed to run the cluster without touching
+// docker. The variables only available at runtime (e.g. ip, mac and the
+// registered outputs) are replaced by placeholders like <ip:etcd-0>, and so
+// is the tag of the images built by the prepare commands.
+func (ce *CloudEnv) Plan() *Plan {
+	ce.RunFlags |= DryRun
+	cs := ce.NewState()
+	for i := 0; i < len(cs.Nodes); i++ {
+		ns := &cs.Nodes[i]
+		ns.initInstances(ns.Node.Instances)
+		ns.Stopped = true
+		for j := 0; j < len(ns.Instances); j++ {
+			is := &ns.Instances[j]
+			is.Stopped = true
+			// the instance sees its own runtime variables as placeholders
+			// too, the same as other instances do
+			is.LocalVars.UpdateVar("ip", "<ip:"+is.Ref()+">")
+			is.LocalVars.UpdateVar("mac", "<mac:"+is.Ref()+">")
+			for _, commands := range ns.Node.Commands {
+				for _, cmd := range commands.Commands {
+					if cmd.Register != "" {
+						is.LocalVars.UpdateVar(cmd.Register, "<out:"+is.Ref()+":"+cmd.Register+">")
+					}
+				}
+			}
+		}
+	}
+
+	plan := &Plan{Cluster: ce.Cluster.Name, DataDir: ce.DataDir, Nodes: make([]NodePlan, len(cs.Nodes))}
+	for i := 0; i < len(cs.Nodes); i++ {
+		ns := &cs.Nodes[i]
+		np := &plan.Nodes[i]
+		varCtx := &VarContext{Cloud: cs, Node: ns}
+		ns.Image = cs.Substitute(ns.Node.Image, varCtx)
+		ns.LocalVars.UpdateVar("image", ns.Image)
+		ns.buildDockerArgs(varCtx)
+		if ns.hasPrepare() {
+			// the tag is the cache key which needs the digest of the base
+			// image from docker
+			np.BaseImage = ns.Image
+			ns.Image = ns.preparedImageName() + ":<prepared>"
+		}
+		ns.appendImageArgs()
+
+		np.Name = ns.Node.Name
+		np.Image = ns.Image
+		np.DependsOn = ns.Node.DependsOn
+		np.Volumes = make([]string, 0)
+		for n := 0; n+1 < len(ns.DockerArgs); n++ {
+			if ns.DockerArgs[n] == "-v" {
+				np.Volumes = append(np.Volumes, ns.DockerArgs[n+1])
+				n++
+			}
+		}
+		np.Prepare = ns.planCommands("prepare", varCtx)
+		np.Instances = make([]InstancePlan, len(ns.Instances))
+		for j := 0; j < len(ns.Instances); j++ {
+			is := &ns.Instances[j]
+			ip := &np.Instances[j]
+			ip.Name = is.Ref()
+			ip.CreateArgs = append([]string{"create", "--cidfile=" + is.cidfile}, ns.DockerArgs...)
+			ip.Commands = make(map[string][]string)
+			for name := range ns.Node.Commands {
+				if name != "prepare" {
+					ip.Commands[name] = ns.planCommands(name, &VarContext{Cloud: cs, Node: ns, Instance: is})
+				}
+			}
+		}
+	}
+	return plan
+}
+
+func (ns *NodeState) planCommands(name string, varCtx *VarContext) []string {
+	cmds := make([]string, 0)
+	if commands, exists := ns.Node.Commands[name]; exists {
+		for _, cmd := range commands.Commands {
+			command := ns.State.Substitute(cmd.Command, varCtx)
+			if command = strings.Trim(command, " "); command != "" {
+				cmds = append(cmds, command)
+			}
+		}
+	}
+	return cmds
+}
+
+// Write prints the plan in human readable form.
+func (p *Plan) Write(w io.Writer) {
+	fmt.Fprintf(w, "Cluster %s (datadir %s)\n", p.Cluster, p.DataDir)
+	for _, np := range p.Nodes {
+		fmt.Fprintf(w, "\nNode %s\n", np.Name)
+		if np.BaseImage != "" {
+			fmt.Fprintf(w, "  image: %s (prepared from %s)\n", np.Image, np.BaseImage)
+		} else {
+			fmt.Fprintf(w, "  image: %s\n", np.Image)
+		}
+		if len(np.DependsOn) > 0 {
+			fmt.Fprintf(w, "  depends on: %s\n", strings.Join(np.DependsOn, ", "))
+		}
+		if len(np.Volumes) > 0 {
+			fmt.Fprintf(w, "  volumes:\n")
+			for _, vol := range np.Volumes {
+				fmt.Fprintf(w, "    %s\n", vol)
+			}
+		}
+		writeCommands(w, "  ", "prepare", np.Prepare)
+		for _, ip := range np.Instances {
+			fmt.Fprintf(w, "  instance %s:\n", ip.Name)
+			fmt.Fprintf(w, "    docker %s\n", shellJoin(ip.CreateArgs))
+			names := make([]string, 0, len(ip.Commands))
+			for name := range ip.Commands {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				writeCommands(w, "    ", name, ip.Commands[name])
+			}
+		}
+	}
+}
+
+func writeCommands(w io.Writer, indent, name string, cmds []string) {
+	if len(cmds) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s%s:\n", indent, name)
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "%s  %s\n", indent, cmd)
+	}
+}
+
+// shellJoin joins args into a shell command line, quoting the arguments
+// which are empty or contain special characters.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for n, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]{}#~!") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted[n] = arg
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,211 @@
+package cargo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	keepAlive = "trap 'exit 0' TERM; while true; do sleep 1; done"
+)
+
+var imageNameRegExp = regexp.MustCompile("[^a-z0-9._-]+")
+
+// preparedImage returns the name of the image derived from the base image
+// by running the prepare commands, qualified with the registry if set. The
+// image is tagged with the cache key.
+func (ns *NodeState) preparedImage() (string, error) {
+	key, err := ns.prepareCacheKey()
+	if err != nil {
+		return "", err
+	}
+	return ns.preparedImageName() + ":" + key[0:32], nil
+}
+
+// preparedImageName returns the name of the prepared image without the tag.
+func (ns *NodeState) preparedImageName() string {
+	name := "cargo-" + ns.State.Env.Cluster.Name + "-" + ns.Node.Name
+	name = imageNameRegExp.ReplaceAllString(strings.ToLower(name), "_")
+	if registry := strings.TrimRight(ns.State.Env.Registry, "/"); registry != "" {
+		name = registry + "/" + name
+	}
+	return name
+}
+
+// prepareCacheKey computes the key from everything affecting the result of
+// the prepare commands: the digest of the base image, the shell, the
+// substituted commands and the contents of the files.
+func (ns *NodeState) prepareCacheKey() (string, error) {
+	digest, err := ns.docker().InspectImage(ns.Image, "{{.Id}}")
+	if err != nil {
+		return "", err
+	}
+
+	commands := ns.Node.Commands["prepare"]
+	varCtx := &VarContext{Cloud: ns.State, Node: ns}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "image %s\nshell %s\n", digest, ns.Node.Shell("prepare"))
+	for _, cmd := range commands.Commands {
+		command := strings.Trim(ns.State.Substitute(cmd.Command, varCtx), " ")
+		fmt.Fprintf(hash, "command %v %s\n", len(command), command)
+	}
+	for _, file := range commands.Files {
+		mapping, err := ParseFileMapping(file)
+		if err != nil {
+			return "", err
+		}
+		if err := hashFiles(hash, path.Join(ns.State.Env.DataDir, mapping.Local), file); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashFiles(hash io.Writer, root, name string) error {
+	return filepath.Walk(root, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, fn)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "file %s %s %v %v\n", name, rel, info.Mode(), info.Size())
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(hash, f)
+		return err
+	})
+}
+
+func (ns *NodeState) hasPrepare() bool {
+	commands, exists := ns.Node.Commands["prepare"]
+	return exists && len(commands.Commands) > 0
+}
+
+// usePreparedImage switches to the prepared image matching the cache key
+// built previously without running the prepare commands.
+func (ns *NodeState) usePreparedImage() {
+	if !ns.hasPrepare() {
+		return
+	}
+	if image, err := ns.preparedImage(); err != nil {
+		ns.Logger.Warning("Prepared image unavailable: %v", err)
+	} else if _, err := ns.docker().InspectImage(image, "{{.Id}}"); err == nil {
+		ns.Image = image
+	}
+}
+
+// prepareNode runs the prepare commands in a throw-away container from the
+// base image, and commits the result to the prepared image which is used
+// to create the containers. The prepared image is reused if it exists
+// locally or in the registry with the same cache key, unless NoCache is
+// set. It is pushed to the registry after being built.
+func (ns *NodeState) prepareNode() error {
+	if !ns.hasPrepare() {
+		return nil
+	}
+
+	image, err := ns.preparedImage()
+	if err != nil {
+		return err
+	}
+	d := ns.docker()
+	if (ns.State.Env.RunFlags & NoCache) == 0 {
+		if _, err := d.InspectImage(image, "{{.Id}}"); err == nil {
+			ns.Logger.Info("Using prepared image %s", image)
+			ns.Image = image
+			return nil
+		}
+		if ns.State.Env.Registry != "" {
+			ns.Logger.Info("Pulling prepared image %s", image)
+			if err := d.Pull(image); err == nil {
+				ns.Image = image
+				return nil
+			}
+		}
+	}
+
+	if err := ns.buildPreparedImage(image); err != nil {
+		return err
+	}
+	ns.Image = image
+
+	if ns.State.Env.Registry != "" {
+		ns.Logger.Info("Pushing prepared image %s", image)
+		if err := d.Push(image); err != nil {
+			ns.Logger.Warning("Push %s failed: %v", image, err)
+		}
+	}
+	return nil
+}
+
+func (ns *NodeState) buildPreparedImage(image string) error {
+	d := ns.docker()
+	// restore the config overridden by the throw-away container
+	changes := make([]string, 0)
+	for _, config := range [][]string{
+		[]string{"ENTRYPOINT", "{{json .Config.Entrypoint}}", "[]"},
+		[]string{"CMD", "{{json .Config.Cmd}}", "[]"},
+		[]string{"WORKDIR", "{{.Config.WorkingDir}}", "/"},
+	} {
+		val, err := d.InspectImage(ns.Image, config[1])
+		if err != nil {
+			return err
+		}
+		if val == "" || val == "null" {
+			val = config[2]
+		}
+		changes = append(changes, config[0]+" "+val)
+	}
+
+	shell := ns.Node.Shell("prepare")
+	args := []string{
+		"-v", ns.State.Env.DataDir + ":" + workspace, "-w", workspace,
+		"--entrypoint", shell,
+	}
+	if ns.Node.Docker.Privileged {
+		args = append(args, "--privileged")
+	}
+	args = append(args, ns.Image, "-c", keepAlive)
+
+	ns.Logger.Info("Preparing image %s from %s", image, ns.Image)
+	is := &InstanceState{
+		NodeState: ns,
+		LocalVars: LocalVarsRepo(),
+		Logger:    ns.Logger.NewLogger(ns.Node.Name + ".prepare"),
+	}
+	var err error
+	// create isn't cancelled, otherwise the container may be left behind
+	// without its id
+	cleanup := Docker(ns.State.Env, ns.Logger)
+	if is.ContainerId, err = cleanup.Create("", args); err != nil {
+		return err
+	}
+	defer cleanup.RmForce(is.ContainerId)
+	if ns.State.Aborted() {
+		return errorAborted
+	}
+	if err = d.Start(is.ContainerId, nil); err != nil {
+		return err
+	}
+	if err = is.runCommands("prepare"); err != nil {
+		return err
+	}
+	if err = d.Stop(is.ContainerId); err != nil {
+		return err
+	}
+	return d.Commit(is.ContainerId, image, changes...)
+}
@@ -0,0 +1,107 @@
+package cargo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReadyInterval = time.Second
+	defaultReadyTimeout  = time.Minute
+	defaultProbeTimeout  = 5 * time.Second
+)
+
+var (
+	errorProbeNoIP = errors.New("No IP address to probe")
+)
+
+// waitReady runs the ready probe of the node until it succeeds, times out,
+// or ctx is done. The instance is ready immediately if there is no probe.
+func (is *InstanceState) waitReady(ctx context.Context) error {
+	probe := &is.NodeState.Node.Ready
+	if probe.Tcp == 0 && probe.Http == "" && probe.Command == "" {
+		return nil
+	}
+	interval, timeout := time.Duration(probe.Interval), time.Duration(probe.Timeout)
+	probeTimeout := time.Duration(probe.ProbeTimeout)
+	if interval == 0 {
+		interval = defaultReadyInterval
+	}
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+	if probeTimeout == 0 {
+		probeTimeout = defaultProbeTimeout
+	}
+
+	is.Logger.Info("Waiting until ready")
+	deadline := time.Now().Add(timeout)
+	for {
+		err := is.probe(ctx, probe, probeTimeout)
+		if err == nil {
+			is.Logger.Info("Ready")
+			return nil
+		} else if ctx.Err() != nil {
+			return errorAborted
+		} else if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("Not ready after %v: %v", timeout, err))
+		}
+		is.Logger.Debug("Not ready: %v", err)
+		if err := sleepContext(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// probe runs all the probes once, each limited by timeout.
+func (is *InstanceState) probe(ctx context.Context, probe *ReadyProbe, timeout time.Duration) error {
+	ip, _ := is.LocalVars.QueryVar("ip", nil)
+	varCtx := &VarContext{Cloud: is.NodeState.State, Node: is.NodeState, Instance: is}
+	if ip == "" && (probe.Tcp != 0 || (probe.Http != "" && !strings.Contains(probe.Http, "://"))) {
+		return errorProbeNoIP
+	}
+	if probe.Tcp != 0 {
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(int(probe.Tcp))))
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	if probe.Http != "" {
+		url := is.NodeState.State.Substitute(probe.Http, varCtx)
+		if !strings.Contains(url, "://") {
+			url = "http://" + ip + ":" + url
+		}
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return errors.New(fmt.Sprintf("GET %s: %s", url, resp.Status))
+		}
+	}
+	if probe.Command != "" {
+		command := is.NodeState.State.Substitute(probe.Command, varCtx)
+		d := is.dockerOutput(ioutil.Discard, ioutil.Discard).WithContext(ctx)
+		if code, err := is.execCommand(d, is.NodeState.Node.Shell("run"), command, timeout); err != nil {
+			return err
+		} else if code != 0 {
+			return errors.New(fmt.Sprintf("Exit %v: %s", code, command))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package cargo
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The phases of an instance in the reference graph. An instance is ready
+// after the containers are created and the ready probe succeeds, and done
+// after the run commands complete. The hooks run on demand afterwards, so
+// nothing waits for them.
+const (
+	phaseReady = iota
+	phaseDone
+	phaseHook
+	phaseCount
+)
+
+var phaseNames = []string{"ready", "done", "hook"}
+
+// referenceError is a problem of the references found in the field at Path
+// of the cluster definition, e.g. nodes[0].run.commands[1].
+type referenceError struct {
+	Path    string
+	Message string
+}
+
+func (e *referenceError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// referenceErrors are all the problems found, at most one per field.
+type referenceErrors []*referenceError
+
+func (errs referenceErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for index, err := range errs {
+		msgs[index] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// add keeps the first problem of each field, as the same field is checked
+// once per instance.
+func (errs referenceErrors) add(err *referenceError) referenceErrors {
+	for _, existing := range errs {
+		if existing.Path == err.Path {
+			return errs
+		}
+	}
+	return append(errs, err)
+}
+
+// refField is a text substituted at runtime and its path in the cluster
+// definition.
+type refField struct {
+	path string
+	text string
+}
+
+// refEdge points to the phase waited for, and the path of the field which
+// makes it wait. subst is set if the field waits by substituting a
+// variable, rather than by the order of the phases.
+type refEdge struct {
+	to    int
+	path  string
+	subst bool
+}
+
+// refGraph is the graph of the phases of all the instances, where an edge
+// means a phase waits for the other one, either through a variable lookup
+// or depends_on.
+type refGraph struct {
+	cluster *Cluster
+	base    []int
+	edges   map[int][]refEdge
+}
+
+// checkReferences rejects the references to nonexistent nodes, instances
+// or registered variables, and the references waiting on each other which
+// would block forever at runtime. All the problems are returned as
+// referenceErrors.
+func checkReferences(cluster *Cluster) error {
+	g := &refGraph{cluster: cluster, base: make([]int, len(cluster.Nodes)), edges: make(map[int][]refEdge)}
+	count := 0
+	for n := range cluster.Nodes {
+		g.base[n] = count
+		count += int(cluster.Nodes[n].Instances)
+	}
+
+	var errs referenceErrors
+	addRefs := func(from, node int, index uint, fields []refField) {
+		for _, field := range fields {
+			for _, err := range g.addRefs(from, node, index, field) {
+				errs = errs.add(err)
+			}
+		}
+	}
+	for n := range cluster.Nodes {
+		node := &cluster.Nodes[n]
+		prefix := fmt.Sprintf("nodes[%v]", n)
+		for i := uint(0); i < node.Instances; i++ {
+			ready, done, hook := g.vertex(n, i, phaseReady), g.vertex(n, i, phaseDone), g.vertex(n, i, phaseHook)
+			g.edges[done] = append(g.edges[done], refEdge{ready, prefix, false})
+			g.edges[hook] = append(g.edges[hook], refEdge{done, prefix, false})
+			// resolved before creating any container of the node
+			addRefs(ready, -1, 0, node.setupFields(prefix))
+			if node.StartBatch > 0 && i >= node.StartBatch {
+				// the previous batch must be ready
+				start := (i/node.StartBatch - 1) * node.StartBatch
+				for j := start; j < start+node.StartBatch; j++ {
+					g.edges[ready] = append(g.edges[ready], refEdge{g.vertex(n, j, phaseReady), prefix + ".start_policy", false})
+				}
+			}
+			for _, name := range node.DependsOn {
+				dep := g.nodeIndex(name)
+				for j := uint(0); j < cluster.Nodes[dep].Instances; j++ {
+					g.edges[ready] = append(g.edges[ready], refEdge{g.vertex(dep, j, phaseReady), prefix + ".depends_on", false})
+				}
+			}
+			addRefs(ready, n, i, node.readyFields(prefix))
+			addRefs(done, n, i, node.doneFields(prefix))
+			addRefs(hook, n, i, node.hookFields(prefix))
+		}
+	}
+	for _, err := range g.findCycles(count * phaseCount) {
+		errs = errs.add(err)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (g *refGraph) vertex(node int, index uint, phase int) int {
+	return (g.base[node]+int(index))*phaseCount + phase
+}
+
+func (g *refGraph) vertexName(v int) string {
+	instance, phase := v/phaseCount, v%phaseCount
+	node := len(g.base) - 1
+	for g.base[node] > instance {
+		node--
+	}
+	return fmt.Sprintf("%s-%v (%s)", g.cluster.Nodes[node].Name, instance-g.base[node], phaseNames[phase])
+}
+
+func (g *refGraph) nodeIndex(name string) int {
+	for n := range g.cluster.Nodes {
+		if g.cluster.Nodes[n].Name == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// instanceIndex resolves a reference like etcd-0.
+func (g *refGraph) instanceIndex(ref string) (int, uint, error) {
+	pos := strings.LastIndex(ref, "-")
+	if pos <= 0 {
+		return -1, 0, errors.New("Bad instance reference " + ref)
+	}
+	node := g.nodeIndex(ref[0:pos])
+	if node < 0 {
+		return -1, 0, errors.New("Node " + ref[0:pos] + " not found")
+	}
+	index, err := strconv.Atoi(ref[pos+1:])
+	if err != nil || index < 0 {
+		return -1, 0, errors.New("Bad instance reference " + ref)
+	} else if uint(index) >= g.cluster.Nodes[node].Instances {
+		return -1, 0, errors.New(fmt.Sprintf("Instance %s out of range, node %s has %v instances",
+			ref, ref[0:pos], g.cluster.Nodes[node].Instances))
+	}
+	return node, uint(index), nil
+}
+
+// addRefs adds the edges from the vertex to the phases referenced by the
+// variables in the field. The references from the instance itself (node,
+// index) never wait, node is -1 if the field is resolved without an
+// instance.
+func (g *refGraph) addRefs(from, node int, index uint, field refField) []*referenceError {
+	var errs []*referenceError
+	text := field.text
+	for _, loc := range varRegExp.FindAllStringIndex(text, -1) {
+		name := text[loc[0]+2 : loc[1]-1]
+		pos := strings.Index(name, ":")
+		if pos <= 0 {
+			continue
+		}
+		key, ref := name[0:pos], name[pos+1:]
+		target, phase := -1, phaseReady
+		var err error
+		var refNode int
+		var refIndex uint
+		switch key {
+		case "instances":
+			if g.nodeIndex(ref) < 0 {
+				err = errors.New("Node " + ref + " not found")
+			}
+		case "ip", "mac":
+			refNode, refIndex, err = g.instanceIndex(ref)
+			target = refNode
+		case "out":
+			if sep := strings.Index(ref, ":"); sep <= 0 {
+				err = errors.New("Bad output reference, expect NODE-INDEX:NAME")
+			} else if refNode, refIndex, err = g.instanceIndex(ref[0:sep]); err == nil {
+				target = refNode
+				phase, err = g.cluster.Nodes[refNode].registerPhase(ref[sep+1:])
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			errs = append(errs, &referenceError{Path: field.path, Message: fmt.Sprintf("%%(%s): %v", name, err)})
+		} else if target >= 0 && (target != node || refIndex != index) {
+			g.edges[from] = append(g.edges[from], refEdge{g.vertex(target, refIndex, phase), field.path, true})
+		}
+	}
+	return errs
+}
+
+// findCycles reports the cycles found in the graph, each at the first field
+// substituting a variable on the cycle.
+func (g *refGraph) findCycles(count int) []*referenceError {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, count)
+	// the vertices being visited and the edges reaching them
+	path := make([]int, 0)
+	via := make([]refEdge, 0)
+	errs := make([]*referenceError, 0)
+
+	var visit func(v int)
+	visit = func(v int) {
+		marks[v] = visiting
+		path = append(path, v)
+		for _, edge := range g.edges[v] {
+			if marks[edge.to] == unvisited {
+				via = append(via, edge)
+				visit(edge.to)
+				via = via[0 : len(via)-1]
+			} else if marks[edge.to] == visiting {
+				errs = append(errs, g.cycleError(path, append(via, edge), edge.to))
+			}
+		}
+		path = path[0 : len(path)-1]
+		marks[v] = visited
+	}
+
+	for v := 0; v < count; v++ {
+		if marks[v] == unvisited {
+			visit(v)
+		}
+	}
+	return errs
+}
+
+// cycleError describes the cycle from v back to itself, where edges[n]
+// leaves path[n].
+func (g *refGraph) cycleError(path []int, edges []refEdge, v int) *referenceError {
+	start := len(path) - 1
+	for path[start] != v {
+		start--
+	}
+	names := make([]string, 0)
+	for _, u := range path[start:] {
+		names = append(names, g.vertexName(u))
+	}
+	at := edges[len(edges)-1].path
+	for _, edge := range edges[start:] {
+		if edge.subst {
+			at = edge.path
+			break
+		}
+	}
+	return &referenceError{Path: at, Message: "Reference cycle: " +
+		strings.Join(append(names, g.vertexName(v)), " -> ")}
+}
+
+// setupFields returns the fields substituted for the node before creating
+// any container.
+func (n *Node) setupFields(prefix string) []refField {
+	fields := []refField{{prefix + ".image", n.Image}, {prefix + ".docker.entrypoint", n.Docker.Entrypoint}}
+	for k, env := range n.Docker.Env {
+		fields = append(fields, refField{fmt.Sprintf("%s.docker.env[%v]", prefix, k), env})
+	}
+	for k, volume := range n.Docker.Volumes {
+		fields = append(fields, refField{fmt.Sprintf("%s.docker.volumes[%v]", prefix, k), volume})
+	}
+	return append(fields, n.commandFields(prefix, "prepare")...)
+}
+
+// readyFields returns the fields substituted for an instance before it is
+// ready.
+func (n *Node) readyFields(prefix string) []refField {
+	return append(n.commandFields(prefix, "post-start"),
+		refField{prefix + ".ready.http", n.Ready.Http}, refField{prefix + ".ready.command", n.Ready.Command})
+}
+
+// doneFields returns the fields substituted for an instance after it is
+// ready.
+func (n *Node) doneFields(prefix string) []refField {
+	fields := []refField{{prefix + ".capture.archive", n.Capture.Archive}}
+	for k, file := range n.Capture.Files {
+		path := fmt.Sprintf("%s.capture.files[%v]", prefix, k)
+		fields = append(fields, refField{path, file.Local}, refField{path, file.Remote})
+	}
+	return append(fields, n.commandFields(prefix, "run", "pre-stop", "post-stop")...)
+}
+
+// hookFields returns the fields of the sets of commands defined under hooks.
+func (n *Node) hookFields(prefix string) []refField {
+	names := make([]string, 0)
+	for name := range n.Commands {
+		if name != "prepare" && !isLifecycleHook(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fields := make([]refField, 0)
+	for _, name := range names {
+		fields = append(fields, n.commandFields(prefix+".hooks", name)...)
+	}
+	return fields
+}
+
+func (n *Node) commandFields(prefix string, names ...string) []refField {
+	fields := make([]refField, 0)
+	for _, name := range names {
+		if commands, exists := n.Commands[name]; exists {
+			for k, cmd := range commands.Commands {
+				fields = append(fields, refField{fmt.Sprintf("%s.%s.commands[%v]", prefix, name, k), cmd.Command})
+			}
+		}
+	}
+	return fields
+}
+
+// registerPhase returns the phase after which the output of a command is
+// available in the named variable. The output registered by prepare never
+// reaches the instances, and the hooks may never run.
+func (n *Node) registerPhase(name string) (int, error) {
+	phase := -1
+	for section, commands := range n.Commands {
+		for _, cmd := range commands.Commands {
+			if cmd.Register != name || section == "prepare" || !isLifecycleHook(section) {
+				continue
+			} else if section == "post-start" {
+				phase = phaseReady
+			} else if phase < 0 {
+				phase = phaseDone
+			}
+		}
+	}
+	if phase < 0 {
+		return phaseDone, errors.New("Variable " + name + " not registered by node " + n.Name)
+	}
+	return phase, nil
+}
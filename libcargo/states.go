@@ -0,0 +1,442 @@
+package cargo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cidSuffix = ".cid"
+)
+
+// InstanceStatus is the state of an instance, or of a node without any
+// instances in which case Instance is empty and State is "none". Error is
+// set if the container can't be inspected with State "error".
+type InstanceStatus struct {
+	Node        string `json:"node"`
+	Instance    string `json:"instance"`
+	Index       uint   `json:"index"`
+	ContainerId string `json:"container_id"`
+	State       string `json:"state"`
+	ExitCode    int    `json:"exit_code"`
+	IP          string `json:"ip"`
+	MAC         string `json:"mac"`
+	Uptime      int64  `json:"uptime"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Attach rebuilds the state of a cluster started previously (e.g. with
+// Detach) from the container ID files persisted in the state directory.
+func (ce *CloudEnv) Attach() (*CloudState, error) {
+	cs := ce.NewState()
+
+	cids := make(map[string]map[uint]string)
+	entries, err := ioutil.ReadDir(cs.stateDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		fn := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fn, cidSuffix) {
+			continue
+		}
+		name := fn[0 : len(fn)-len(cidSuffix)]
+		pos := strings.LastIndex(name, ".")
+		if pos <= 0 {
+			continue
+		}
+		index, err := strconv.ParseUint(name[pos+1:], 10, 32)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(cs.stateDir, fn))
+		if err != nil {
+			return nil, err
+		}
+		if cid := strings.Trim(string(data), " \n\r\t\f"); cid != "" {
+			if cids[name[0:pos]] == nil {
+				cids[name[0:pos]] = make(map[uint]string)
+			}
+			cids[name[0:pos]][uint(index)] = cid
+		}
+	}
+
+	for i := 0; i < len(cs.Nodes); i++ {
+		ns := &cs.Nodes[i]
+		var count uint
+		for index := range cids[ns.Node.Name] {
+			if index >= count {
+				count = index + 1
+			}
+		}
+		ns.initInstances(count)
+		for j := 0; j < len(ns.Instances); j++ {
+			is := &ns.Instances[j]
+			if is.ContainerId = cids[ns.Node.Name][is.Index]; is.ContainerId != "" {
+				is.publishAddresses()
+			}
+			is.Stopped = true
+		}
+		ns.LocalVars.UpdateVar("instances", fmt.Sprintf("%v", len(ns.existingInstances())))
+		ns.Stopped = true
+	}
+	return cs, nil
+}
+
+type ExecResult struct {
+	Instance *InstanceState
+	ExitCode int
+	Error    error
+}
+
+type LogsOptions struct {
+	Follow bool
+	Since  string
+	Tail   string
+}
+
+// SelectInstances finds the instances with containers by references. A
+// reference is either a node name for all its instances, or NODE-INDEX for
+// a single instance. All the instances are selected if refs is empty.
+func (cs *CloudState) SelectInstances(refs []string) ([]*InstanceState, error) {
+	instances := make([]*InstanceState, 0)
+	if len(refs) == 0 {
+		for i := 0; i < len(cs.Nodes); i++ {
+			instances = append(instances, cs.Nodes[i].existingInstances()...)
+		}
+		return instances, nil
+	}
+	for _, ref := range refs {
+		if ns := cs.NodeByName(ref); ns != nil {
+			existing := ns.existingInstances()
+			if len(existing) == 0 {
+				return nil, errors.New("No instances found for node " + ref)
+			}
+			instances = append(instances, existing...)
+		} else if is := cs.InstanceByRef(ref); is != nil && is.ContainerId != "" {
+			instances = append(instances, is)
+		} else {
+			return nil, errors.New("Instance not found: " + ref)
+		}
+	}
+	return instances, nil
+}
+
+func (cs *CloudState) NodeByName(name string) *NodeState {
+	for i := 0; i < len(cs.Nodes); i++ {
+		if cs.Nodes[i].Node.Name == name {
+			return &cs.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// InstanceByRef finds the instance referenced as NODE-INDEX.
+func (cs *CloudState) InstanceByRef(ref string) *InstanceState {
+	pos := strings.LastIndex(ref, "-")
+	if pos <= 0 {
+		return nil
+	}
+	ns := cs.NodeByName(ref[0:pos])
+	if ns == nil {
+		return nil
+	}
+	index, err := strconv.Atoi(ref[pos+1:])
+	if err != nil || index < 0 || index >= len(ns.Instances) {
+		return nil
+	}
+	return &ns.Instances[index]
+}
+
+func (ns *NodeState) existingInstances() []*InstanceState {
+	instances := make([]*InstanceState, 0, len(ns.Instances))
+	for j := 0; j < len(ns.Instances); j++ {
+		if ns.Instances[j].ContainerId != "" {
+			instances = append(instances, &ns.Instances[j])
+		}
+	}
+	return instances
+}
+
+// Logs writes the logs of the instances to stdout and stderr with each line
+// prefixed by the instance reference.
+func (cs *CloudState) Logs(instances []*InstanceState, opts *LogsOptions, stdout, stderr io.Writer) error {
+	args := make([]string, 0)
+	if opts.Follow {
+		args = append(args, "--follow")
+	}
+	if opts.Since != "" {
+		args = append(args, "--since="+opts.Since)
+	}
+	if opts.Tail != "" {
+		args = append(args, "--tail="+opts.Tail)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	prefixes := instancePrefixes(instances)
+	errs := make([]error, len(instances))
+	for n, is := range instances {
+		wg.Add(1)
+		go func(n int, is *InstanceState) {
+			outWriter := PrefixWriter(stdout, prefixes[n], &lock)
+			errWriter := PrefixWriter(stderr, prefixes[n], &lock)
+			errs[n] = is.docker().Logs(is.ContainerId, outWriter, errWriter, args...)
+			outWriter.Close()
+			errWriter.Close()
+			wg.Done()
+		}(n, is)
+	}
+	wg.Wait()
+
+	for n, err := range errs {
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %v", instances[n].Ref(), err))
+		}
+	}
+	return nil
+}
+
+// Exec runs a command in the instances in parallel. If there are more than
+// one instance, each line of the output is prefixed by the instance
+// reference.
+func (cs *CloudState) Exec(instances []*InstanceState, command string, stdout, stderr io.Writer) []ExecResult {
+	if len(instances) == 1 {
+		exitCode, err := instances[0].Exec(command, stdout, stderr)
+		return []ExecResult{ExecResult{Instance: instances[0], ExitCode: exitCode, Error: err}}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	prefixes := instancePrefixes(instances)
+	results := make([]ExecResult, len(instances))
+	for n, is := range instances {
+		wg.Add(1)
+		go func(n int, is *InstanceState) {
+			outWriter := PrefixWriter(stdout, prefixes[n], &lock)
+			errWriter := PrefixWriter(stderr, prefixes[n], &lock)
+			results[n].Instance = is
+			results[n].ExitCode, results[n].Error = is.Exec(command, outWriter, errWriter)
+			outWriter.Close()
+			errWriter.Close()
+			wg.Done()
+		}(n, is)
+	}
+	wg.Wait()
+	return results
+}
+
+func instancePrefixes(instances []*InstanceState) []string {
+	width := 0
+	for _, is := range instances {
+		if len(is.Ref()) > width {
+			width = len(is.Ref())
+		}
+	}
+	prefixes := make([]string, len(instances))
+	for n, is := range instances {
+		prefixes[n] = fmt.Sprintf("%-*s | ", width, is.Ref())
+	}
+	return prefixes
+}
+
+// Restart recreates and starts the containers of the instances, keeping the
+// volumes of the old containers. The run commands are executed again if Run
+// is set in RunFlags.
+func (cs *CloudState) Restart(instances []*InstanceState) {
+	cs.Env.RunFlags |= Detach
+	for _, is := range instances {
+		if ns := is.NodeState; ns.DockerArgs == nil && ns.Error == nil {
+			if ns.Error = ns.setup(); ns.Error != nil {
+				ns.Logger.Error("%v", ns.Error)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, is := range instances {
+		if is.NodeState.Error != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(is *InstanceState) {
+			is.Logger.Info("Restarting")
+			// stopped here to run the stop hooks, the container is
+			// replaced by run keeping the volumes
+			if is.Error = is.stop(); is.Error == nil {
+				is.Error = is.run(is.NodeState, is.Index)
+			}
+			if is.Error != nil {
+				is.Logger.Error("%v", is.Error)
+			}
+			cs.Notify()
+			wg.Done()
+		}(is)
+	}
+	wg.Wait()
+}
+
+// Scale changes the number of instances of the node. New instances are
+// created with indices continuing from the highest existing one, and the
+// surplus instances are stopped and removed from the highest index down.
+func (cs *CloudState) Scale(ns *NodeState, count uint) {
+	existing := ns.existingInstances()
+	current := uint(len(existing))
+	ns.LocalVars.UpdateVar("instances", fmt.Sprintf("%v", count))
+	if count < current {
+		ns.Logger.Info("Scaling down from %v to %v", current, count)
+		for n := len(existing) - 1; n >= int(count); n-- {
+			is := existing[n]
+			if is.Error = is.stop(); is.Error == nil {
+				is.Error = is.remove()
+			}
+			if is.Error != nil {
+				is.Logger.Error("%v", is.Error)
+			}
+		}
+		return
+	} else if count == current {
+		ns.Logger.Info("Already %v instances", count)
+		return
+	}
+
+	ns.Logger.Info("Scaling up from %v to %v", current, count)
+	if ns.Error = ns.setup(); ns.Error != nil {
+		ns.Logger.Error("%v", ns.Error)
+		return
+	}
+
+	first := len(ns.Instances)
+	instances := make([]InstanceState, first+int(count-current))
+	copy(instances, ns.Instances)
+	ns.Instances = instances
+
+	cs.Env.RunFlags |= Detach
+	var wg sync.WaitGroup
+	for j := first; j < len(ns.Instances); j++ {
+		is := &ns.Instances[j]
+		is.init(ns, uint(j))
+		wg.Add(1)
+		go func(is *InstanceState) {
+			if is.Error = is.run(ns, is.Index); is.Error != nil {
+				is.Logger.Error("%v", is.Error)
+			}
+			is.Stopped = true
+			cs.Notify()
+			wg.Done()
+		}(is)
+	}
+	wg.Wait()
+}
+
+// Instances returns the number of instances which have containers.
+func (cs *CloudState) Instances() int {
+	count := 0
+	for i := 0; i < len(cs.Nodes); i++ {
+		for j := 0; j < len(cs.Nodes[i].Instances); j++ {
+			if cs.Nodes[i].Instances[j].ContainerId != "" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Status inspects the containers of all the instances, with a row for each
+// node without any containers. Instances whose containers no longer exist
+// are reported with state "missing".
+func (cs *CloudState) Status() []InstanceStatus {
+	result := make([]InstanceStatus, 0, cs.Instances()+len(cs.Nodes))
+	for i := 0; i < len(cs.Nodes); i++ {
+		ns := &cs.Nodes[i]
+		count := 0
+		for j := 0; j < len(ns.Instances); j++ {
+			is := &ns.Instances[j]
+			if is.ContainerId == "" {
+				continue
+			}
+			count++
+			status := InstanceStatus{
+				Node:        ns.Node.Name,
+				Instance:    is.Ref(),
+				Index:       is.Index,
+				ContainerId: is.ContainerId,
+				State:       "missing",
+			}
+			if info, err := is.docker().InspectContainer(is.ContainerId); err != nil {
+				if err != errorNoSuchContainer {
+					status.State = "error"
+					status.Error = err.Error()
+				}
+			} else {
+				status.ExitCode = info.State.ExitCode
+				status.IP = info.NetworkSettings.IPAddress
+				status.MAC = info.NetworkSettings.MacAddress
+				if status.State = info.State.Status; status.State == "" {
+					if info.State.Running {
+						status.State = "running"
+					} else {
+						status.State = "exited"
+					}
+				}
+				if info.State.Running {
+					status.Uptime = int64(time.Since(info.State.StartedAt) / time.Second)
+				}
+			}
+			result = append(result, status)
+		}
+		if count == 0 {
+			result = append(result, InstanceStatus{Node: ns.Node.Name, State: "none"})
+		}
+	}
+	return result
+}
+
+// Shutdown stops all the instances in the reverse order of starting, and
+// removes the containers if Remove is set. The result is reported per
+// instance and kept in Error.
+func (cs *CloudState) Shutdown() {
+	cs.teardown(func(is *InstanceState) {
+		if is.ContainerId == "" {
+			return
+		}
+		if is.Error = is.shutdown(); is.Error != nil {
+			is.Logger.Error("%v", is.Error)
+		}
+	})
+}
+
+func (is *InstanceState) shutdown() error {
+	if _, err := is.docker().Inspect(is.ContainerId, "{{.Id}}"); err != nil {
+		if err != errorNoSuchContainer {
+			return err
+		}
+		is.Logger.Warning("Container %s no longer exists", is.ContainerId)
+		os.Remove(is.cidfile)
+		is.ContainerId = ""
+		return nil
+	}
+	if running, err := is.docker().isRunning(is.ContainerId); err != nil {
+		return err
+	} else if running {
+		if err := is.stop(); err != nil && (is.NodeState.State.Env.RunFlags&Force) == 0 {
+			return err
+		}
+		is.Logger.Info("Stopped")
+	}
+	if (is.NodeState.State.Env.RunFlags & Remove) != 0 {
+		if err := is.remove(); err != nil {
+			return err
+		}
+		is.Logger.Info("Removed")
+	}
+	return nil
+}
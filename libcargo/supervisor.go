@@ -0,0 +1,198 @@
+package cargo
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	superviseInterval     = time.Second
+	defaultRestartBackoff = time.Second
+	maxRestartBackoff     = time.Minute
+	// the restart attempts are reset once the container keeps running
+	// this long, the same as docker does
+	restartResetAfter = 10 * time.Second
+)
+
+// Supervisor watches the containers of a running cluster and restarts the
+// exited ones according to the restart policies of the nodes.
+type Supervisor struct {
+	State *CloudState
+
+	// ctx is cancelled by Stop or when the cluster is aborted
+	ctx     context.Context
+	cancel  context.CancelFunc
+	exited  chan struct{}
+	probes  sync.WaitGroup
+	watches map[*InstanceState]*watch
+}
+
+// watch is the restart state of an instance. generation is protected by
+// the lock of the CloudState and tells whether a ready probe is stale.
+type watch struct {
+	attempts   uint
+	restart    time.Time
+	pending    bool
+	done       bool
+	generation uint
+}
+
+// Supervise starts watching all the instances with containers.
+func (cs *CloudState) Supervise() *Supervisor {
+	s := &Supervisor{
+		State:   cs,
+		exited:  make(chan struct{}),
+		watches: make(map[*InstanceState]*watch),
+	}
+	s.ctx, s.cancel = context.WithCancel(cs.ctx)
+	for i := 0; i < len(cs.Nodes); i++ {
+		ns := &cs.Nodes[i]
+		for j := 0; j < len(ns.Instances); j++ {
+			if is := &ns.Instances[j]; is.ContainerId != "" {
+				s.watches[is] = &watch{}
+			}
+		}
+	}
+	go s.run()
+	return s
+}
+
+// Done is closed when the supervisor exits, either stopped or no container
+// is running or going to be restarted.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.exited
+}
+
+// Stop stops watching and waits until the supervisor and the ready probes
+// of the restarted containers exit. No containers are restarted afterwards.
+func (s *Supervisor) Stop() {
+	s.cancel()
+	<-s.exited
+	s.probes.Wait()
+}
+
+func (s *Supervisor) run() {
+	defer close(s.exited)
+	ticker := time.NewTicker(superviseInterval)
+	defer ticker.Stop()
+	for {
+		active := false
+		for is, w := range s.watches {
+			if !w.done {
+				s.check(is, w)
+			}
+			active = active || !w.done
+		}
+		if !active || s.State.Aborted() {
+			return
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check restarts the container if exited and the policy allows.
+func (s *Supervisor) check(is *InstanceState, w *watch) {
+	if w.pending {
+		if time.Now().Before(w.restart) {
+			return
+		}
+		w.pending = false
+		s.restart(is, w)
+		return
+	}
+
+	info, err := is.cleanupDocker().InspectContainer(is.ContainerId)
+	if err == errorNoSuchContainer {
+		is.Logger.Warning("Container %s no longer exists", is.ContainerId)
+		w.done = true
+		return
+	} else if err != nil {
+		is.Logger.Warning("Inspect failed, retry later: %v", err)
+		return
+	} else if info.State.Running {
+		if w.attempts > 0 && time.Since(info.State.StartedAt) >= restartResetAfter {
+			is.Logger.Debug("Running for %v, reset restart attempts", restartResetAfter)
+			w.attempts = 0
+		}
+		return
+	}
+
+	policy := &is.NodeState.Node.Restart
+	switch {
+	case policy.Policy == RestartAlways:
+	case policy.Policy == RestartOnFailure && info.State.ExitCode != 0:
+	default:
+		is.Logger.Info("Exited with code %v", info.State.ExitCode)
+		w.done = true
+		return
+	}
+	if policy.MaxAttempts > 0 && w.attempts >= policy.MaxAttempts {
+		is.Logger.Error("Exited with code %v, giving up after %v restarts", info.State.ExitCode, w.attempts)
+		w.done = true
+		return
+	}
+
+	backoff := time.Duration(policy.Backoff)
+	if backoff == 0 {
+		backoff = defaultRestartBackoff
+	}
+	for n := uint(0); n < w.attempts && backoff < maxRestartBackoff; n++ {
+		backoff *= 2
+	}
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	w.attempts++
+	w.pending = true
+	w.restart = time.Now().Add(backoff)
+	is.Logger.Warning("Exited with code %v, restarting in %v (attempt %v)", info.State.ExitCode, backoff, w.attempts)
+}
+
+// restart starts the container again and publishes the new addresses. The
+// instance is not ready until the ready probe succeeds again.
+func (s *Supervisor) restart(is *InstanceState, w *watch) {
+	cs := s.State
+	cs.Lock()
+	is.Ready = false
+	w.generation++
+	generation := w.generation
+	cs.Unlock()
+
+	var err error
+	if (cs.Env.RunFlags & Detach) != 0 {
+		err = is.docker().Start(is.ContainerId, nil)
+	} else {
+		err = is.docker().Start(is.ContainerId, &cs.WaitGroup)
+	}
+	if err != nil {
+		is.Logger.Error("Restart failed: %v", err)
+		return
+	}
+	is.publishAddresses()
+	cs.Lock()
+	cs.Notify()
+	cs.Unlock()
+	is.Logger.Info("Restarted")
+
+	s.probes.Add(1)
+	go func() {
+		defer s.probes.Done()
+		err := is.waitReady(s.ctx)
+		if s.ctx.Err() != nil {
+			return
+		} else if err != nil {
+			is.Logger.Error("%v", err)
+		}
+		cs.Lock()
+		if w.generation == generation {
+			is.Ready = err == nil
+			cs.Notify()
+		}
+		cs.Unlock()
+	}()
+}
@@ -2,12 +2,45 @@ package cargo
 
 import (
 	"fmt"
-	"gopkg.in/yaml.v1"
+	"gopkg.in/yaml.v3"
 )
 
-func yamlDecode(data []byte) (interface{}, error) {
+// yamlBools are the plain scalars resolved to booleans by yaml.v1, which
+// yaml.v3 only treats as strings except true and false.
+var yamlBools = map[string]bool{
+	"y": true, "Y": true, "yes": true, "Yes": true, "YES": true,
+	"on": true, "On": true, "ON": true,
+	"n": false, "N": false, "no": false, "No": false, "NO": false,
+	"off": false, "Off": false, "OFF": false,
+}
+
+func yamlParse(data []byte) (*yaml.Node, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	yamlV1Bools(doc)
+	return doc, nil
+}
+
+// yamlV1Bools retags the plain scalars which yaml.v1 resolved to booleans,
+// so the definition files keep the same meaning for both the validator and
+// the decoder.
+func yamlV1Bools(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Style == 0 && node.Tag == "!!str" {
+		if val, exists := yamlBools[node.Value]; exists {
+			node.Tag = "!!bool"
+			node.Value = fmt.Sprintf("%v", val)
+		}
+	}
+	for _, child := range node.Content {
+		yamlV1Bools(child)
+	}
+}
+
+func yamlDecode(doc *yaml.Node) (interface{}, error) {
 	var in interface{}
-	if err := yaml.Unmarshal(data, &in); err != nil {
+	if err := doc.Decode(&in); err != nil {
 		return nil, err
 	}
 	return yamlFix(in)
@@ -25,6 +58,16 @@ func yamlFix(in interface{}) (interface{}, error) {
 			}
 		}
 		return o, nil
+	case map[string]interface{}:
+		o := make(map[string]interface{})
+		for k, v := range in.(map[string]interface{}) {
+			if val, err := yamlFix(v); err != nil {
+				return nil, err
+			} else {
+				o[k] = val
+			}
+		}
+		return o, nil
 	case []interface{}:
 		array := in.([]interface{})
 		l := len(array)
@@ -0,0 +1,491 @@
+package cargo
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strings"
+)
+
+type ValidationError struct {
+	Path    string
+	Line    int
+	Column  int
+	Message string
+	Warning bool
+}
+
+type ValidationErrors []*ValidationError
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v:%v: %s: %s", e.Line, e.Column, e.Path, e.Message)
+}
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for index, err := range errs {
+		msgs[index] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Errors returns the problems excluding warnings.
+func (errs ValidationErrors) Errors() ValidationErrors {
+	result := make(ValidationErrors, 0, len(errs))
+	for _, err := range errs {
+		if !err.Warning {
+			result = append(result, err)
+		}
+	}
+	return result
+}
+
+type fieldValidator func(v *validator, node *yaml.Node, path string)
+
+type validator struct {
+	errors ValidationErrors
+}
+
+// Validate checks the parsed cluster definitions and reports all the
+// problems found, including unknown keys as warnings.
+func Validate(doc *yaml.Node) ValidationErrors {
+	v := &validator{errors: make(ValidationErrors, 0)}
+	if doc.Kind == 0 || (doc.Kind == yaml.DocumentNode && len(doc.Content) == 0) {
+		v.fail(doc, "", "Empty document")
+		return v.errors
+	} else if doc.Kind == yaml.DocumentNode {
+		doc = doc.Content[0]
+	}
+	v.root(doc)
+	return v.errors
+}
+
+func (v *validator) fail(node *yaml.Node, path, format string, args ...interface{}) {
+	v.errors = append(v.errors, &ValidationError{
+		Path:    rootPath(path),
+		Line:    node.Line,
+		Column:  node.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) warn(node *yaml.Node, path, format string, args ...interface{}) {
+	v.fail(node, path, format, args...)
+	v.errors[len(v.errors)-1].Warning = true
+}
+
+func rootPath(path string) string {
+	if path == "" {
+		return "."
+	}
+	return strings.TrimPrefix(path, ".")
+}
+
+func resolve(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+// mapping validates the keys of a mapping with the validators of known
+// fields. The required fields must be present.
+func (v *validator) mapping(node *yaml.Node, path string, fields map[string]fieldValidator, required ...string) map[string]*yaml.Node {
+	node = resolve(node)
+	if node.Kind != yaml.MappingNode {
+		v.fail(node, path, "Expect a mapping")
+		return nil
+	}
+	values := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], resolve(node.Content[i+1])
+		fieldPath := path + "." + key.Value
+		if _, exists := values[key.Value]; exists {
+			v.fail(key, fieldPath, "Duplicated key %s", key.Value)
+		} else if validate, known := fields[key.Value]; !known {
+			v.warn(key, fieldPath, "Unknown key %s", key.Value)
+		} else {
+			validate(v, val, fieldPath)
+		}
+		values[key.Value] = val
+	}
+	for _, name := range required {
+		if _, exists := values[name]; !exists {
+			v.fail(node, path, "Missing %s", name)
+		}
+	}
+	return values
+}
+
+func (v *validator) sequence(node *yaml.Node, path string, item fieldValidator) {
+	if node.Kind != yaml.SequenceNode {
+		v.fail(node, path, "Expect a list")
+		return
+	}
+	for index, child := range node.Content {
+		item(v, resolve(child), fmt.Sprintf("%s[%v]", path, index))
+	}
+}
+
+// validateString only warns about empty strings, which are valid values
+// though likely mistakes.
+func validateString(v *validator, node *yaml.Node, path string) {
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!str" {
+		v.fail(node, path, "Expect a string, quote the value if needed")
+	} else if node.Value == "" {
+		v.warn(node, path, "Empty string")
+	}
+}
+
+// validateName is for the strings which must not be empty, like names.
+func validateName(v *validator, node *yaml.Node, path string) {
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!str" {
+		v.fail(node, path, "Expect a string, quote the value if needed")
+	} else if node.Value == "" {
+		v.fail(node, path, "Must not be empty")
+	}
+}
+
+func validateBool(v *validator, node *yaml.Node, path string) {
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+		v.fail(node, path, "Expect true or false")
+	}
+}
+
+func validateUint(v *validator, node *yaml.Node, path string) {
+	var val int64
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!int" || node.Decode(&val) != nil || val < 0 {
+		v.fail(node, path, "Expect a non-negative integer")
+	}
+}
+
+func validatePort(v *validator, node *yaml.Node, path string) {
+	var val int64
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!int" || node.Decode(&val) != nil || val <= 0 || val > 65535 {
+		v.fail(node, path, "Expect a port number")
+	}
+}
+
+func validateEnum(values ...string) fieldValidator {
+	return func(v *validator, node *yaml.Node, path string) {
+		if node.Kind == yaml.ScalarNode {
+			for _, val := range values {
+				if node.Value == val {
+					return
+				}
+			}
+		}
+		v.fail(node, path, "Expect one of %s", strings.Join(values, ", "))
+	}
+}
+
+func validateDuration(v *validator, node *yaml.Node, path string) {
+	if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		v.fail(node, path, "Expect a duration")
+	} else if _, err := ParseDuration(node.Value); err != nil {
+		v.fail(node, path, "%v", err)
+	}
+}
+
+var varNameRegExp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_.-]*$")
+
+func validateVarName(v *validator, node *yaml.Node, path string) {
+	if node.Kind != yaml.ScalarNode || !varNameRegExp.MatchString(node.Value) {
+		v.fail(node, path, "Expect a variable name of letters, digits, _, . or -")
+	} else if reservedVars[node.Value] {
+		v.fail(node, path, "Variable %s is reserved", node.Value)
+	}
+}
+
+func validateFileMapping(v *validator, node *yaml.Node, path string) {
+	if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		v.fail(node, path, "Expect a string")
+	} else if _, err := ParseFileMapping(node.Value); err != nil {
+		v.fail(node, path, "%v", err)
+	}
+}
+
+func validateStrings(v *validator, node *yaml.Node, path string) {
+	v.sequence(node, path, validateString)
+}
+
+func (v *validator) root(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "clusters" {
+				v.clusters(node)
+				return
+			}
+		}
+	}
+	v.cluster(node, "", false)
+}
+
+func (v *validator) clusters(node *yaml.Node) {
+	values := v.mapping(node, "", map[string]fieldValidator{
+		"clusters": func(v *validator, node *yaml.Node, path string) {
+			v.sequence(node, path, func(v *validator, node *yaml.Node, path string) {
+				v.cluster(node, path, true)
+			})
+		},
+		"default": validateName,
+	})
+
+	names := make(map[string]bool)
+	if clusters := values["clusters"]; clusters != nil && clusters.Kind == yaml.SequenceNode {
+		for index, cluster := range clusters.Content {
+			cluster = resolve(cluster)
+			if name := mappingValue(cluster, "name"); name != nil && name.Kind == yaml.ScalarNode {
+				if names[name.Value] {
+					v.fail(name, fmt.Sprintf(".clusters[%v].name", index), "Duplicated cluster %s", name.Value)
+				}
+				names[name.Value] = true
+			}
+		}
+		if len(clusters.Content) == 0 {
+			v.fail(clusters, ".clusters", "No clusters defined")
+		}
+	}
+	if def := values["default"]; def != nil && def.Kind == yaml.ScalarNode && def.Value != "" && !names[def.Value] {
+		v.fail(def, ".default", "Default cluster %s not found", def.Value)
+	}
+}
+
+func (v *validator) cluster(node *yaml.Node, path string, named bool) {
+	required := []string{"nodes"}
+	if named {
+		required = append(required, "name")
+	}
+	values := v.mapping(node, path, map[string]fieldValidator{
+		"name": validateName,
+		"nodes": func(v *validator, node *yaml.Node, path string) {
+			v.sequence(node, path, (*validator).node)
+		},
+	}, required...)
+
+	nodes := values["nodes"]
+	if nodes == nil || nodes.Kind != yaml.SequenceNode {
+		return
+	}
+	if len(nodes.Content) == 0 {
+		v.fail(nodes, path+".nodes", "No nodes defined")
+	}
+	names := make(map[string]bool)
+	for index, node := range nodes.Content {
+		if name := mappingValue(resolve(node), "name"); name != nil && name.Kind == yaml.ScalarNode {
+			if names[name.Value] {
+				v.fail(name, fmt.Sprintf("%s.nodes[%v].name", path, index), "Duplicated node %s", name.Value)
+			}
+			names[name.Value] = true
+		}
+	}
+	v.dependencies(nodes, path+".nodes", names)
+}
+
+// dependencies checks depends_on of the nodes refer to existing nodes
+// without cycles.
+func (v *validator) dependencies(nodes *yaml.Node, path string, names map[string]bool) {
+	deps := make([]Node, 0, len(nodes.Content))
+	for index, node := range nodes.Content {
+		node = resolve(node)
+		name := mappingValue(node, "name")
+		if name == nil || name.Kind != yaml.ScalarNode {
+			continue
+		}
+		dep := Node{Name: name.Value}
+		if dependsOn := mappingValue(node, "depends_on"); dependsOn != nil && dependsOn.Kind == yaml.SequenceNode {
+			for n, item := range dependsOn.Content {
+				item = resolve(item)
+				if !names[item.Value] {
+					v.fail(item, fmt.Sprintf("%s[%v].depends_on[%v]", path, index, n), "Node %s not found", item.Value)
+				} else {
+					dep.DependsOn = append(dep.DependsOn, item.Value)
+				}
+			}
+		}
+		deps = append(deps, dep)
+	}
+	if _, err := dependencyOrder(deps); err != nil {
+		v.fail(nodes, path, "%v", err)
+	}
+}
+
+func (v *validator) node(node *yaml.Node, path string) {
+	fields := map[string]fieldValidator{
+		"name":         validateName,
+		"image":        validateName,
+		"instances":    validateUint,
+		"depends_on":   validateStrings,
+		"ready":        (*validator).ready,
+		"start_policy": (*validator).startPolicy,
+		"restart":      (*validator).restart,
+		"docker":       (*validator).docker,
+		"capture":      (*validator).capture,
+		"hooks":        (*validator).hooks,
+	}
+	for _, name := range lifecycleHooks {
+		fields[name] = (*validator).commands
+	}
+	v.mapping(node, path, fields, "name", "image")
+}
+
+func (v *validator) hooks(node *yaml.Node, path string) {
+	if node.Kind != yaml.MappingNode {
+		v.fail(node, path, "Expect a mapping")
+		return
+	}
+	fields := make(map[string]fieldValidator)
+	for i := 0; i < len(node.Content); i += 2 {
+		fields[node.Content[i].Value] = (*validator).commands
+	}
+	for _, name := range lifecycleHooks {
+		name := name
+		fields[name] = func(v *validator, node *yaml.Node, path string) {
+			v.fail(node, path, "Hook name %s is reserved for a lifecycle section", name)
+		}
+	}
+	v.mapping(node, path, fields)
+}
+
+func (v *validator) commands(node *yaml.Node, path string) {
+	v.mapping(node, path, map[string]fieldValidator{
+		"files": func(v *validator, node *yaml.Node, path string) {
+			v.sequence(node, path, validateFileMapping)
+		},
+		"shell":       validateString,
+		"timeout":     validateDuration,
+		"retries":     validateUint,
+		"retry_delay": validateDuration,
+		"commands": func(v *validator, node *yaml.Node, path string) {
+			v.sequence(node, path, (*validator).command)
+		},
+	})
+}
+
+func (v *validator) command(node *yaml.Node, path string) {
+	if node.Kind == yaml.ScalarNode {
+		validateString(v, node, path)
+		return
+	}
+	v.mapping(node, path, map[string]fieldValidator{
+		"command":     validateString,
+		"timeout":     validateDuration,
+		"retries":     validateUint,
+		"retry_delay": validateDuration,
+		"register":    validateVarName,
+	}, "command")
+}
+
+func (v *validator) startPolicy(node *yaml.Node, path string) {
+	if node.Kind == yaml.ScalarNode {
+		validateEnum(StartParallel, StartSerial)(v, node, path)
+		return
+	}
+	v.mapping(node, path, map[string]fieldValidator{
+		"batch": func(v *validator, node *yaml.Node, path string) {
+			var val int64
+			if node.Kind != yaml.ScalarNode || node.Tag != "!!int" || node.Decode(&val) != nil || val <= 0 {
+				v.fail(node, path, "Expect a positive integer")
+			}
+		},
+	}, "batch")
+}
+
+func (v *validator) restart(node *yaml.Node, path string) {
+	policies := validateEnum(RestartNever, RestartOnFailure, RestartAlways)
+	if node.Kind == yaml.ScalarNode {
+		policies(v, node, path)
+		return
+	}
+	v.mapping(node, path, map[string]fieldValidator{
+		"policy":       policies,
+		"max_attempts": validateUint,
+		"backoff":      validateDuration,
+	}, "policy")
+}
+
+func (v *validator) ready(node *yaml.Node, path string) {
+	values := v.mapping(node, path, map[string]fieldValidator{
+		"tcp":           validatePort,
+		"http":          validateString,
+		"command":       validateString,
+		"interval":      validateDuration,
+		"timeout":       validateDuration,
+		"probe_timeout": validateDuration,
+	})
+	if values != nil && values["tcp"] == nil && values["http"] == nil && values["command"] == nil {
+		v.fail(node, path, "Expect at least one of tcp, http, command")
+	}
+}
+
+func (v *validator) docker(node *yaml.Node, path string) {
+	v.mapping(node, path, map[string]fieldValidator{
+		"entrypoint": validateString,
+		"cmd":        validateStrings,
+		"env":        validateStrings,
+		"privileged": validateBool,
+		"volumes":    validateStrings,
+	})
+}
+
+func (v *validator) capture(node *yaml.Node, path string) {
+	v.mapping(node, path, map[string]fieldValidator{
+		"files": func(v *validator, node *yaml.Node, path string) {
+			v.sequence(node, path, (*validator).captureFile)
+		},
+		"archive": validateString,
+		"when":    validateEnum(CaptureAlways, CaptureSuccess, CaptureFailure),
+	})
+}
+
+func (v *validator) captureFile(node *yaml.Node, path string) {
+	if node.Kind == yaml.ScalarNode {
+		validateString(v, node, path)
+		return
+	}
+	v.mapping(node, path, map[string]fieldValidator{
+		"local":  validateString,
+		"remote": validateString,
+		"when":   validateEnum(CaptureAlways, CaptureSuccess, CaptureFailure),
+	}, "remote")
+}
+
+var pathRegExp = regexp.MustCompile(`[^.\[\]]+|\[\d+\]`)
+
+// lookupPath finds the node at a path like nodes[0].run.commands[1], or the
+// closest parent found.
+func lookupPath(doc *yaml.Node, path string) *yaml.Node {
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = resolve(node.Content[0])
+	}
+	for _, elem := range pathRegExp.FindAllString(path, -1) {
+		var next *yaml.Node
+		if strings.HasPrefix(elem, "[") {
+			var index int
+			fmt.Sscanf(elem, "[%d]", &index)
+			if node.Kind == yaml.SequenceNode && index < len(node.Content) {
+				next = resolve(node.Content[index])
+			}
+		} else {
+			next = mappingValue(node, elem)
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return resolve(node.Content[i+1])
+		}
+	}
+	return nil
+}
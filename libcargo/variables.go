@@ -24,6 +24,18 @@ type VarProviderFactory func() VarProvider
 
 var (
 	VarProviders = make(map[string]VarProviderFactory)
+
+	// reservedVars are the local variables set by cargo which can't be
+	// registered from the output of commands.
+	reservedVars = map[string]bool{
+		"template":  true,
+		"image":     true,
+		"instances": true,
+		"instance":  true,
+		"index":     true,
+		"ip":        true,
+		"mac":       true,
+	}
 )
 
 type localVars struct {
@@ -1,7 +1,6 @@
 package cargo
 
 import (
-	"strconv"
 	"strings"
 )
 
@@ -22,6 +21,8 @@ func (p *providerXref) QueryVar(name string, context *VarContext, repo VarReposi
 		return queryNode(context, ref, key)
 	case "ip", "mac":
 		return queryInstance(context, ref, key)
+	case "out":
+		return queryOutput(context, ref)
 	}
 	return
 }
@@ -31,7 +32,7 @@ func providerFactoryXref() VarProvider {
 }
 
 func queryNode(ctx *VarContext, ref, key string) (val string, exists bool) {
-	ns := findNode(ctx, ref)
+	ns := ctx.Cloud.NodeByName(ref)
 	if ns == nil {
 		return
 	}
@@ -41,7 +42,7 @@ func queryNode(ctx *VarContext, ref, key string) (val string, exists bool) {
 	}
 
 	ctx.Cloud.Lock()
-	for !ns.Stopped {
+	for !ns.Stopped && !ctx.Cloud.Aborted() {
 		if val, exists = ns.LocalVars.QueryVar(key, ctx); exists {
 			break
 		}
@@ -52,28 +53,49 @@ func queryNode(ctx *VarContext, ref, key string) (val string, exists bool) {
 }
 
 func queryInstance(ctx *VarContext, ref, key string) (val string, exists bool) {
-	pos := strings.LastIndex(ref, "-")
-	if pos <= 0 {
+	is := ctx.Cloud.InstanceByRef(ref)
+	if is == nil {
 		return
 	}
-	ns := findNode(ctx, ref[0:pos])
-	if ns == nil {
+	return waitInstanceVar(ctx, is, key, "<"+key+":"+ref+">")
+}
+
+// queryOutput looks up the output registered by a command in another
+// instance, referenced as NODE-INDEX:NAME.
+func queryOutput(ctx *VarContext, ref string) (val string, exists bool) {
+	pos := strings.Index(ref, ":")
+	if pos <= 0 {
 		return
 	}
-	index, err := strconv.Atoi(ref[pos+1:])
-	if err != nil || index < 0 || index >= len(ns.Instances) {
+	is := ctx.Cloud.InstanceByRef(ref[0:pos])
+	if is == nil {
 		return
 	}
+	return waitInstanceVar(ctx, is, ref[pos+1:], "<out:"+ref+">")
+}
 
-	is := &ns.Instances[index]
-
-	if val, exists = is.LocalVars.QueryVar(key, ctx); exists || is == ctx.Instance {
+// waitInstanceVar waits until the instance is ready with the variable
+// available, or stops. The placeholder is returned in a dry run.
+func waitInstanceVar(ctx *VarContext, is *InstanceState, key, placeholder string) (val string, exists bool) {
+	if is == ctx.Instance {
+		return is.LocalVars.QueryVar(key, ctx)
+	}
+	if (ctx.Cloud.Env.RunFlags & DryRun) != 0 {
+		if val, exists = is.LocalVars.QueryVar(key, ctx); !exists {
+			val, exists = placeholder, true
+		}
 		return
 	}
 
 	ctx.Cloud.Lock()
-	for !is.Stopped {
-		if val, exists = is.LocalVars.QueryVar(key, ctx); exists {
+	for {
+		done := is.Stopped || ctx.Cloud.Aborted()
+		if is.Ready || done {
+			if val, exists = is.LocalVars.QueryVar(key, ctx); exists {
+				break
+			}
+		}
+		if done {
 			break
 		}
 		ctx.Cloud.Wait()
@@ -82,17 +104,9 @@ func queryInstance(ctx *VarContext, ref, key string) (val string, exists bool) {
 	return
 }
 
-func findNode(ctx *VarContext, name string) *NodeState {
-	for i := 0; i < len(ctx.Cloud.Nodes); i++ {
-		if ctx.Cloud.Nodes[i].Node.Name == name {
-			return &ctx.Cloud.Nodes[i]
-		}
-	}
-	return nil
-}
-
 func init() {
 	VarProviders["instances"] = providerFactoryXref
 	VarProviders["ip"] = providerFactoryXref
 	VarProviders["mac"] = providerFactoryXref
+	VarProviders["out"] = providerFactoryXref
 }